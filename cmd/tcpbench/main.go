@@ -0,0 +1,159 @@
+//TCPServer 压测工具，建立N个 TCPClient 连接按指定速率发送消息，统计往返延迟和吞吐量
+//用法: tcpbench -addr 127.0.0.1:8000 -conns 100 -proto byte -size 128 -rate 100 -duration 30s
+//服务器需要把收到的包原样发回，可以使用 tcpecho
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/zdq007/go-common/tcp"
+	"github.com/zdq007/go-common/test"
+)
+
+var (
+	addr     = flag.String("addr", "127.0.0.1:8000", "服务器地址")
+	conns    = flag.Int("conns", 10, "连接数")
+	proto    = flag.String("proto", "json", "分包协议 json|byte")
+	size     = flag.Int("size", 64, "消息体大小(字节)，不小于20")
+	rate     = flag.Int("rate", 0, "每个连接每秒发送的消息数，0为收到回复后立即发送下一条")
+	duration = flag.Duration("duration", 10*time.Second, "压测时长")
+)
+
+var (
+	sent      int64 //发送的消息数
+	sentBytes int64 //发送的字节数
+	errCount  int64 //发送失败数
+)
+
+func main() {
+	flag.Parse()
+	seraddr, err := net.ResolveTCPAddr("tcp", *addr)
+	if err != nil {
+		fmt.Println("地址错误:", err)
+		os.Exit(2)
+	}
+	if *size < 20 {
+		*size = 20
+	}
+	protoType := tcp.PROTO_JSON
+	if *proto == "byte" {
+		protoType = tcp.PROTO_BYTE
+	}
+	counter := test.NewTest()
+	counter.Counter(1000, func(count int64) {
+		fmt.Printf("收到: %d/s  发送: %d  错误: %d\n", count, atomic.LoadInt64(&sent), atomic.LoadInt64(&errCount))
+	})
+	clients := make([]*tcp.TCPClient, 0, *conns)
+	stop := make(chan struct{})
+	for i := 0; i < *conns; i++ {
+		client := tcp.NewTCPClient()
+		client.SetProto(protoType)
+		writer := tcp.NewFrameWriter(client, protoType)
+		next := make(chan struct{}, 1)
+		client.On("data", func(data []byte) {
+			if protoType == tcp.PROTO_BYTE {
+				data = data[tcp.HEAD_LEN:]
+			}
+			if sendAt := parseTime(data); sendAt > 0 {
+				counter.AddLatency(time.Duration(time.Now().UnixNano() - sendAt))
+			}
+			select {
+			case next <- struct{}{}:
+			default:
+			}
+		})
+		if err := client.Connect(seraddr); err != nil {
+			fmt.Println("连接失败:", err)
+			os.Exit(1)
+		}
+		clients = append(clients, client)
+		go sender(writer, next, stop)
+	}
+	start := time.Now()
+	time.Sleep(*duration)
+	close(stop)
+	//等待最后的回复
+	time.Sleep(500 * time.Millisecond)
+	elapsed := time.Since(start)
+	for _, client := range clients {
+		client.Close()
+	}
+	report(counter.Stat(), elapsed)
+}
+
+//发送消息，消息体以发送时间的纳秒数开头，用于计算往返延迟
+func sender(writer *tcp.FrameWriter, next chan struct{}, stop chan struct{}) {
+	payload := bytes.Repeat([]byte{'x'}, *size)
+	var tick <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(*rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-stop:
+				return
+			}
+		} else {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+		stamp := strconv.AppendInt(payload[:0], time.Now().UnixNano(), 10)
+		payload[len(stamp)] = '|'
+		n, err := writer.WriteFrame(1, 0, payload)
+		if err != nil {
+			atomic.AddInt64(&errCount, 1)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		atomic.AddInt64(&sent, 1)
+		atomic.AddInt64(&sentBytes, int64(n))
+		if tick == nil {
+			select {
+			case <-next:
+			case <-time.After(5 * time.Second):
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+//解析消息体开头的发送时间
+func parseTime(data []byte) int64 {
+	i := bytes.IndexByte(data, '|')
+	if i <= 0 {
+		return 0
+	}
+	t, err := strconv.ParseInt(string(data[:i]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return t
+}
+
+//打印汇总报告
+func report(stat test.Stat, elapsed time.Duration) {
+	secs := elapsed.Seconds()
+	fmt.Println("========== 压测报告 ==========")
+	fmt.Printf("服务器:   %s  协议: %s\n", *addr, *proto)
+	fmt.Printf("连接数:   %d  消息大小: %d  速率: %d/s/conn\n", *conns, *size, *rate)
+	fmt.Printf("时长:     %s\n", elapsed)
+	fmt.Printf("发送:     %d  错误: %d  收到: %d\n", atomic.LoadInt64(&sent), atomic.LoadInt64(&errCount), stat.Count)
+	fmt.Printf("吞吐量:   %.0f msg/s  %.2f MB/s\n", float64(stat.Count)/secs, float64(atomic.LoadInt64(&sentBytes))/secs/1024/1024)
+	fmt.Printf("延迟:     min %s  avg %s  max %s\n", stat.Min, stat.Avg, stat.Max)
+	fmt.Printf("百分位:   p50 %s  p90 %s  p99 %s  p99.9 %s\n", stat.P50, stat.P90, stat.P99, stat.P999)
+}
@@ -0,0 +1,54 @@
+//回显服务器，把收到的包原样发回，配合 tcpbench 压测使用
+//用法: tcpecho -addr :8000 -proto byte
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/zdq007/go-common/tcp"
+)
+
+func main() {
+	addr := flag.String("addr", ":8000", "监听地址")
+	proto := flag.String("proto", "json", "分包协议 json|byte")
+	epoll := flag.Bool("epoll", false, "使用epoll事件循环模式(linux)")
+	flag.Parse()
+	tcpaddr, err := net.ResolveTCPAddr("tcp", *addr)
+	if err != nil {
+		fmt.Println("地址错误:", err)
+		os.Exit(2)
+	}
+	protoType := tcp.PROTO_JSON
+	if *proto == "byte" {
+		protoType = tcp.PROTO_BYTE
+	}
+	ser := tcp.NewTCPServer()
+	ser.SetProto(protoType)
+	ser.On("start", func(port int) {
+		fmt.Println("回显服务器启动，端口:", port)
+	})
+	ser.On("connect", func(conn *tcp.Client) {
+		conn.Set("writer", tcp.NewFrameWriter(conn, protoType))
+	})
+	ser.On("data", func(conn *tcp.Client, data []byte) {
+		if protoType == tcp.PROTO_BYTE {
+			//字节协议的包含包头，原样写回
+			conn.Write(data)
+		} else {
+			conn.Get("writer").(*tcp.FrameWriter).WriteJson(data)
+		}
+	})
+	var ok bool
+	if *epoll {
+		ok = ser.ListenEpoll(tcpaddr)
+	} else {
+		ok = ser.Listen(tcpaddr)
+	}
+	if !ok {
+		fmt.Println("监听失败:", *addr)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,43 @@
+//会话回放工具，把 tcp.Recorder 记录的客户端发出的数据重新发送给服务器
+//用法: tcpreplay -file session.rec -addr 127.0.0.1:8000 -speed 2
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zdq007/go-common/tcp"
+)
+
+func main() {
+	file := flag.String("file", "", "记录文件")
+	addr := flag.String("addr", "127.0.0.1:8000", "服务器地址")
+	speed := flag.Float64("speed", 1, "回放速度倍数，0为不等待尽快回放")
+	dump := flag.Bool("dump", false, "只打印记录内容，不回放")
+	flag.Parse()
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	start := time.Now()
+	var err error
+	if *dump {
+		err = tcp.Replay(*file, 0, func(rec *tcp.Record) error {
+			dir := "<-"
+			if rec.Dir == tcp.REC_OUT {
+				dir = "->"
+			}
+			fmt.Printf("%s conn:%d %s %d %q\n", rec.Time.Format("15:04:05.000000"), rec.Connid, dir, len(rec.Data), rec.Data)
+			return nil
+		})
+	} else {
+		err = tcp.ReplayToAddr(*file, *addr, *speed)
+	}
+	if err != nil {
+		fmt.Println("回放失败:", err)
+		os.Exit(1)
+	}
+	fmt.Println("回放完成，用时:", time.Since(start))
+}
@@ -0,0 +1,178 @@
+package tcp
+
+import (
+	"sync"
+	"time"
+)
+
+type attrEntry struct {
+	val    interface{}
+	expire int64 //过期时间 UnixNano，0 不过期
+}
+
+func (self attrEntry) expired(now int64) bool {
+	return self.expire > 0 && now >= self.expire
+}
+
+//属性变化的回调，删除或过期时 val 为nil
+type AttrHook func(key string, old, val interface{})
+
+//并发安全的属性存储，支持过期时间和变化回调
+//过期的属性在下次访问时删除，删除时同样回调 AttrHook
+type Attrs struct {
+	data  map[string]attrEntry
+	lock  sync.RWMutex
+	hooks event[AttrHook]
+}
+
+func NewAttrs() *Attrs {
+	return &Attrs{data: make(map[string]attrEntry, 2)}
+}
+
+//注册属性变化的回调，返回的函数用于注销，回调在修改属性的协程中执行
+func (self *Attrs) AddHook(fn AttrHook) func() {
+	return self.hooks.add(0, fn)
+}
+
+func (self *Attrs) emit(key string, old, val interface{}) {
+	for _, l := range self.hooks.load() {
+		callHook(l.fn, key, old, val)
+	}
+}
+
+func callHook(fn AttrHook, key string, old, val interface{}) {
+	defer recoverEvent()
+	fn(key, old, val)
+}
+
+func (self *Attrs) Set(key string, val interface{}) {
+	self.SetTTL(key, val, 0)
+}
+
+//设置属性，ttl 后过期，ttl<=0 不过期
+func (self *Attrs) SetTTL(key string, val interface{}, ttl time.Duration) {
+	now := time.Now().UnixNano()
+	entry := attrEntry{val: val}
+	if ttl > 0 {
+		entry.expire = now + int64(ttl)
+	}
+	self.lock.Lock()
+	old, ok := self.data[key]
+	self.data[key] = entry
+	self.lock.Unlock()
+	if ok && old.expired(now) {
+		old.val = nil
+	}
+	self.emit(key, old.val, val)
+}
+
+//读取属性，不存在或已过期时 ok 为false
+func (self *Attrs) Lookup(key string) (val interface{}, ok bool) {
+	self.lock.RLock()
+	entry, ok := self.data[key]
+	self.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if entry.expired(time.Now().UnixNano()) {
+		self.expire(key)
+		return nil, false
+	}
+	return entry.val, true
+}
+
+func (self *Attrs) Get(key string) interface{} {
+	val, _ := self.Lookup(key)
+	return val
+}
+
+func (self *Attrs) Del(key string) {
+	self.lock.Lock()
+	old, ok := self.data[key]
+	delete(self.data, key)
+	self.lock.Unlock()
+	if ok {
+		self.emit(key, old.val, nil)
+	}
+}
+
+//删除过期的属性，期间被重新设置的不删除
+func (self *Attrs) expire(key string) {
+	now := time.Now().UnixNano()
+	self.lock.Lock()
+	old, ok := self.data[key]
+	if ok && old.expired(now) {
+		delete(self.data, key)
+	} else {
+		ok = false
+	}
+	self.lock.Unlock()
+	if ok {
+		self.emit(key, old.val, nil)
+	}
+}
+
+//未过期的属性名
+func (self *Attrs) Keys() []string {
+	now := time.Now().UnixNano()
+	var expired []string
+	self.lock.RLock()
+	keys := make([]string, 0, len(self.data))
+	for key, entry := range self.data {
+		if entry.expired(now) {
+			expired = append(expired, key)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	self.lock.RUnlock()
+	for _, key := range expired {
+		self.expire(key)
+	}
+	return keys
+}
+
+//未过期属性的快照
+func (self *Attrs) All() map[string]interface{} {
+	now := time.Now().UnixNano()
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	all := make(map[string]interface{}, len(self.data))
+	for key, entry := range self.data {
+		if !entry.expired(now) {
+			all[key] = entry.val
+		}
+	}
+	return all
+}
+
+func (self *Attrs) Len() int {
+	return len(self.Keys())
+}
+
+//复制另一组属性的值，不触发回调，用于会话恢复
+func (self *Attrs) copyFrom(src *Attrs) {
+	src.lock.RLock()
+	defer src.lock.RUnlock()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key, entry := range src.data {
+		self.data[key] = entry
+	}
+}
+
+//可按名称读取属性的对象，*Attrs 和 *Client 都实现了这个接口
+type AttrReader interface {
+	Lookup(key string) (interface{}, bool)
+}
+
+//按类型读取属性，不存在、已过期或类型不符时 ok 为false
+//例如 uid, ok := tcp.GetAs[uint64](conn, "uid")
+func GetAs[T any](attrs AttrReader, key string) (val T, ok bool) {
+	v, found := attrs.Lookup(key)
+	if !found {
+		return val, false
+	}
+	val, ok = v.(T)
+	return val, ok
+}
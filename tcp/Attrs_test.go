@@ -0,0 +1,123 @@
+package tcp
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+type attrChange struct {
+	key      string
+	old, val interface{}
+}
+
+func recordHooks(attrs *Attrs) (*[]attrChange, func()) {
+	changes := new([]attrChange)
+	remove := attrs.AddHook(func(key string, old, val interface{}) {
+		*changes = append(*changes, attrChange{key, old, val})
+	})
+	return changes, remove
+}
+
+//过期的属性读不到，并在访问时以 val 为nil回调
+func TestAttrsTTL(t *testing.T) {
+	attrs := NewAttrs()
+	attrs.SetTTL("code", "1234", 10*time.Millisecond)
+	attrs.Set("uid", 7)
+	if val, ok := attrs.Lookup("code"); !ok || val != "1234" {
+		t.Fatal(val, ok)
+	}
+	changes, _ := recordHooks(attrs)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := attrs.All()["code"]; ok {
+		t.Fatal("All returned an expired attr")
+	}
+	if keys := attrs.Keys(); len(keys) != 1 || keys[0] != "uid" {
+		t.Fatalf("keys %v", keys)
+	}
+	if _, ok := attrs.Lookup("code"); ok {
+		t.Fatal("code should have expired")
+	}
+	if len(*changes) != 1 || (*changes)[0] != (attrChange{"code", "1234", nil}) {
+		t.Fatalf("changes %v", *changes)
+	}
+	//覆盖已过期的属性时旧值为nil
+	attrs.SetTTL("token", "a", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	attrs.Set("token", "b")
+	if last := (*changes)[len(*changes)-1]; last != (attrChange{"token", nil, "b"}) {
+		t.Fatalf("last change %v", last)
+	}
+	if attrs.Len() != 2 {
+		t.Fatalf("len %d", attrs.Len())
+	}
+}
+
+//设置、覆盖、删除都回调，注销后不再回调，回调中的 panic 不影响其它回调
+func TestAttrsHooks(t *testing.T) {
+	attrs := NewAttrs()
+	attrs.AddHook(func(key string, old, val interface{}) { panic("hook") })
+	changes, remove := recordHooks(attrs)
+	attrs.Set("a", 1)
+	attrs.Set("a", 2)
+	attrs.Del("a")
+	attrs.Del("missing")
+	want := []attrChange{{"a", nil, 1}, {"a", 1, 2}, {"a", 2, nil}}
+	if len(*changes) != len(want) {
+		t.Fatalf("changes %v", *changes)
+	}
+	for i := range want {
+		if (*changes)[i] != want[i] {
+			t.Fatalf("changes %v, want %v", *changes, want)
+		}
+	}
+	remove()
+	attrs.Set("b", 1)
+	if len(*changes) != len(want) {
+		t.Fatal("hook called after remove")
+	}
+	//copyFrom 不回调
+	src := NewAttrs()
+	src.Set("c", 3)
+	src.Set("d", 4)
+	changes, _ = recordHooks(attrs)
+	attrs.copyFrom(src)
+	keys := attrs.Keys()
+	sort.Strings(keys)
+	if len(*changes) != 0 || len(keys) != 3 || keys[1] != "c" {
+		t.Fatalf("changes %v, keys %v", *changes, keys)
+	}
+}
+
+//类型不符、不存在、已过期时 GetAs 返回零值和false
+func TestGetAs(t *testing.T) {
+	attrs := NewAttrs()
+	attrs.Set("uid", uint64(7))
+	attrs.Set("name", "bob")
+	attrs.SetTTL("code", 1234, time.Millisecond)
+	if uid, ok := GetAs[uint64](attrs, "uid"); !ok || uid != 7 {
+		t.Fatal(uid, ok)
+	}
+	if uid, ok := GetAs[int](attrs, "uid"); ok || uid != 0 {
+		t.Fatal(uid, ok)
+	}
+	if name, ok := GetAs[int64](attrs, "name"); ok || name != 0 {
+		t.Fatal(name, ok)
+	}
+	if _, ok := GetAs[string](attrs, "missing"); ok {
+		t.Fatal("missing key found")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if code, ok := GetAs[int](attrs, "code"); ok || code != 0 {
+		t.Fatal(code, ok)
+	}
+	//Client 同样实现了 AttrReader
+	client := &Client{attrs: NewAttrs()}
+	client.Set("uid", uint64(8))
+	if uid, ok := GetAs[uint64](client, "uid"); !ok || uid != 8 {
+		t.Fatal(uid, ok)
+	}
+	if client.GetInt("uid") != 0 || client.GetUint64("uid") != 8 {
+		t.Fatal("typed getters mismatch")
+	}
+}
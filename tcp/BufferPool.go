@@ -0,0 +1,109 @@
+package tcp
+
+import (
+	"io"
+	"sync"
+)
+
+//缓冲池的分级大小，取缓冲时按不小于所需大小的最小级别分配
+var bufClasses = []int{512, 1024, 2 * 1024, 4 * 1024, 8 * 1024, 16 * 1024, 32 * 1024, 64 * 1024, 128 * 1024}
+
+var bufPools = func() []*sync.Pool {
+	pools := make([]*sync.Pool, len(bufClasses))
+	for i, size := range bufClasses {
+		size := size
+		pools[i] = &sync.Pool{New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}}
+	}
+	return pools
+}()
+
+//查找大小对应的级别，超过最大级别返回-1
+func bufClass(size int) int {
+	for i, c := range bufClasses {
+		if size <= c {
+			return i
+		}
+	}
+	return -1
+}
+
+//从缓冲池取出长度为 size 的缓冲，用完后调用 PutBuf 归还
+func GetBuf(size int) *[]byte {
+	i := bufClass(size)
+	if i < 0 {
+		buf := make([]byte, size)
+		return &buf
+	}
+	bufp := bufPools[i].Get().(*[]byte)
+	*bufp = (*bufp)[:size]
+	return bufp
+}
+
+//归还缓冲，容量不属于任何级别的缓冲直接丢弃
+func PutBuf(bufp *[]byte) {
+	c := cap(*bufp)
+	i := bufClass(c)
+	if i < 0 || bufClasses[i] != c {
+		return
+	}
+	*bufp = (*bufp)[:c]
+	bufPools[i].Put(bufp)
+}
+
+//把一个 PacketHead 格式的包追加到 dst 后面，dst 容量足够时不分配内存
+//包头长度字段只有2字节，data 超过 0xFFFF 时返回 TO_LAGER，大包需要协商后通过 Codec 编码
+func AppendFrame(dst []byte, ver, msgtype byte, targetid uint64, data []byte) ([]byte, error) {
+	dl := len(data)
+	if dl > 0xFFFF {
+		return dst, TO_LAGER
+	}
+	dst = append(dst, ver, msgtype, byte(dl>>8), byte(dl),
+		byte(targetid>>56), byte(targetid>>48), byte(targetid>>40), byte(targetid>>32),
+		byte(targetid>>24), byte(targetid>>16), byte(targetid>>8), byte(targetid))
+	return append(dst, data...), nil
+}
+
+//帧写入器，复用内部缓冲封包后一次写出，可以并发调用
+type FrameWriter struct {
+	w         io.Writer
+	protoType int
+	buf       []byte
+	lock      *sync.Mutex
+}
+
+//protoType 为 PROTO_JSON 时追加 \r\n 分隔符，为 PROTO_BYTE 时加 PacketHead 包头
+func NewFrameWriter(w io.Writer, protoType int) *FrameWriter {
+	return &FrameWriter{
+		w:         w,
+		protoType: protoType,
+		buf:       make([]byte, 0, JSON_CLIENT_BUF),
+		lock:      new(sync.Mutex),
+	}
+}
+
+//封包并写出，msgtype 和 targetid 只对 PROTO_BYTE 有效，PROTO_BYTE 的 data 超过 0xFFFF 时返回 TO_LAGER
+func (self *FrameWriter) WriteFrame(msgtype byte, targetid uint64, data []byte) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.protoType == PROTO_BYTE {
+		if self.buf, err = AppendFrame(self.buf[:0], 1, msgtype, targetid, data); err != nil {
+			return 0, err
+		}
+	} else {
+		self.buf = append(append(self.buf[:0], data...), 13, 10)
+	}
+	n, err = self.w.Write(self.buf)
+	//超大的缓冲不保留，避免长期占用内存
+	if cap(self.buf) > int(RECV_BUF) {
+		self.buf = make([]byte, 0, JSON_CLIENT_BUF)
+	}
+	return
+}
+
+//写出一个JSON包
+func (self *FrameWriter) WriteJson(data []byte) (n int, err error) {
+	return self.WriteFrame(0, 0, data)
+}
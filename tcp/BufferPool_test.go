@@ -0,0 +1,53 @@
+package tcp
+
+import (
+	"testing"
+)
+
+func TestAppendFrameTooLarge(t *testing.T) {
+	dst := make([]byte, 0, HEAD_LEN)
+	if _, err := AppendFrame(dst, 1, 1, 0, make([]byte, 0xFFFF+1)); err != TO_LAGER {
+		t.Fatalf("want TO_LAGER, got %v", err)
+	}
+	frame, err := AppendFrame(dst, 1, 1, 0, make([]byte, 0xFFFF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head := NewPacketHead(frame); head.Datalen != 0xFFFF {
+		t.Fatalf("datalen %d", head.Datalen)
+	}
+	if WarpData(1, make([]byte, 0xFFFF+1)) != nil {
+		t.Fatal("WarpData should reject oversized data")
+	}
+}
+
+func BenchmarkAppendFrame(b *testing.B) {
+	data := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		bufp := GetBuf(int(HEAD_LEN) + len(data))
+		if _, err := AppendFrame((*bufp)[:0], 1, 1, uint64(i), data); err != nil {
+			b.Fatal(err)
+		}
+		PutBuf(bufp)
+	}
+}
+
+func BenchmarkSplitPackage(b *testing.B) {
+	//一次读到多个完整包加半个包
+	var stream []byte
+	for i := 0; i < 8; i++ {
+		stream, _ = AppendFrame(stream, 1, 1, uint64(i), make([]byte, 256))
+	}
+	half := len(stream) - 100
+	proto := NewByteProto(func(conn *Client, data []byte) {}, func(conn *Client) {}, func(conn *Client, err error) {
+		b.Fatal(err)
+	})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stream)))
+	for i := 0; i < b.N; i++ {
+		proto.SplitPackage(nil, stream[:half])
+		proto.SplitPackage(nil, stream[half:])
+	}
+}
@@ -21,9 +21,8 @@ const (
 
 //自定义协议 包由包长度决定
 type ByteProto struct {
-	readbuf []byte //数据读取缓冲BUF
-	dl      uint32 //数据开始的位置
-	rl      uint32 //数据结束的位置
+	buf     []byte //未拆完的半截包
+	codec   *Codec //协商后的编解码方式
 	OnError func(conn *Client, err error)
 	OnData  func(conn *Client, data []byte)
 	OnClose func(conn *Client)
@@ -31,7 +30,7 @@ type ByteProto struct {
 
 func NewByteProto(OnData func(conn *Client, data []byte), OnClose func(conn *Client), OnError func(conn *Client, err error)) (proto *ByteProto) {
 	proto = new(ByteProto)
-	proto.readbuf = make([]byte, RECV_BUF)
+	proto.codec = defaultCodec
 	proto.OnError = OnError
 	proto.OnData = OnData
 	proto.OnClose = OnClose
@@ -46,18 +45,21 @@ type PacketHead struct {
 	Targetid uint64 //目标ID   8字节
 }
 
-//判断是否需要移动剩余缓冲字节到buf的开始位置
+//设置协商后的编解码方式
+func (self *ByteProto) SetCodec(codec *Codec) {
+	self.codec = codec
+}
+
+//检查缓存的半截包是否过大
 func (self *ByteProto) CheckReadBuffer() error {
-	if (RECV_BUF - self.rl) < MIN_BUF {
-		copy(self.readbuf, self.readbuf[self.dl:self.rl])
-		self.rl = self.rl - self.dl
-		self.dl = 0
+	max := MAX_BUF
+	if self.codec.Has(FEATURE_LARGE) {
+		max = LARGE_MAX_BUF + HEAD_LEN + 4
 	}
-	if (self.rl - self.dl) > MAX_BUF {
-		logger.Error("包过大,包长：", self.rl-self.dl)
+	if uint32(len(self.buf)) > max {
+		logger.Error("包过大,包长：", len(self.buf))
 		return TO_LAGER
 	}
-
 	return nil
 }
 
@@ -65,18 +67,19 @@ func (self *ByteProto) CheckReadBuffer() error {
 func (self *ByteProto) Read(client *Client) {
 	control := true
 	clientAddr := client.conn.RemoteAddr()
-	count := 0
 	conn := client.conn
-	readbuf := self.readbuf
-	//now:=time.Now()
+	bufp := GetBuf(int(RECV_BUF))
+	defer PutBuf(bufp)
+	readbuf := *bufp
 	for control {
-		if err := self.CheckReadBuffer(); err != nil {
-			client.Close()
-		}
-		n, err := conn.Read(readbuf[self.rl:])
+		n, err := conn.Read(readbuf)
 		if err != nil {
 			control = false
-			if !client.isClosed {
+			if client.handingOff() {
+				//连接正在移交给新进程，不关闭
+				break
+			}
+			if !client.closed() && client.notifyClose() {
 				logger.Debug(clientAddr, "连接异常!", err)
 				client.Close()
 				if err.Error() == "EOF" {
@@ -90,38 +93,65 @@ func (self *ByteProto) Read(client *Client) {
 		if n <= 0 {
 			control = false
 			logger.Debug("客户端关闭连接")
-			if !client.isClosed {
+			if !client.closed() && client.notifyClose() {
 				client.Close()
 				self.OnClose(client)
 			}
 			break
 		}
-		self.rl += uint32(n)
-		count += n
-		//logger.Debug("接收到数据长度:", n)
-		//fmt.Println("接收到时数据：", n, " 总数据：", count, "时间：", time.Since(now))
-		self.SplitPackage(client, readbuf)
+		self.SplitPackage(client, readbuf[:n])
 	}
 }
 
-//拆包
+//缓存中半截包的长度
+func (self *ByteProto) pending() int {
+	return len(self.buf)
+}
+
+//拆包，readbuf 为本次读到的数据，不完整的包会缓存到下次拼接
 func (self *ByteProto) SplitPackage(client *Client, readbuf []byte) {
-	logger.Debug("数据:", readbuf[self.dl:self.rl])
+	data := readbuf
+	if len(self.buf) > 0 {
+		self.buf = append(self.buf, readbuf...)
+		data = self.buf
+	}
+	var dl uint32
+	rl := uint32(len(data))
 	for {
 		//当前消息包的长度
-		if self.rl-self.dl < HEAD_LEN {
+		packlen, ok := self.codec.frameLen(data[dl:])
+		if !ok {
 			break
 		}
-		packlen := binary.BigEndian.Uint16(readbuf[self.dl+HEAD_PACKETLEN_POS:])
 		//计算出 完整包的结束游标
-		completelen := self.dl + HEAD_LEN + uint32(packlen)
-		if self.rl < completelen {
+		completelen := dl + packlen
+		if rl < completelen {
 			break
 		}
-		packet := readbuf[self.dl:completelen]
-		self.dl = completelen
+		packet, err := self.codec.Decode(data[dl:completelen])
+		dl = completelen
+		if err != nil {
+			//校验失败的包丢弃
+			self.OnError(client, err)
+			continue
+		}
 		self.OnData(client, packet)
 	}
+	//缓存半截包
+	if len(self.buf) > 0 {
+		self.buf = self.buf[:copy(self.buf, data[dl:])]
+	} else {
+		self.buf = append(self.buf[:0], data[dl:]...)
+	}
+	if err := self.CheckReadBuffer(); err != nil {
+		self.buf = self.buf[:0]
+		if client != nil {
+			client.Close()
+		}
+		if client == nil || client.notifyClose() {
+			self.OnError(client, err)
+		}
+	}
 }
 
 func NewPacketHead2(ver, msgtype byte, datalen uint16, targetid uint64) (ph *PacketHead) {
@@ -150,17 +180,14 @@ func (self *PacketHead) ToString() {
 	logger.Debug("版本号：", self.Version, "消息类型：", self.Msgtype, "包长度：", self.Datalen, "目标ID：", self.Targetid)
 }
 
+//封包，data 超过 0xFFFF 时无法封包，返回nil
 func WarpData(msgtype byte, data []byte) []byte {
-	dl := 0
-	if data != nil {
-		dl = len(data)
-	}
-	ph := NewPacketHead2(1, msgtype, uint16(dl), 0)
-	rdata := ph.ToByte()
-	if data != nil && dl > 0 {
-		copy(rdata[HEAD_LEN:], data)
+	packet, err := AppendFrame(make([]byte, 0, int(HEAD_LEN)+len(data)), 1, msgtype, 0, data)
+	if err != nil {
+		logger.Error("包过大,包长：", len(data))
+		return nil
 	}
-	return rdata
+	return packet
 }
 
 //连接
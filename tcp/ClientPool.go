@@ -0,0 +1,308 @@
+package tcp
+
+import (
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//负载均衡策略
+const (
+	BALANCE_ROUND_ROBIN   = iota //轮询
+	BALANCE_LEAST_PENDING        //选未收到回包的请求最少的节点
+	BALANCE_HASH                 //按key一致性哈希，同一个key总是落到同一个节点
+)
+
+const (
+	POOL_HASH_REPLICAS = 100 //一致性哈希每个节点的虚拟节点数
+)
+
+var (
+	ErrNoNode = errors.New("no healthy node")
+)
+
+//连接池中的节点
+type poolNode struct {
+	addr    string
+	client  *TCPClient
+	healthy int32 //1 可用，连接断开或出错后置0，重连成功或再次收到数据后恢复
+	pending int64 //已发出未收到回包的请求数，适用于一问一答的协议
+}
+
+func (self *poolNode) isHealthy() bool {
+	return atomic.LoadInt32(&self.healthy) == 1
+}
+
+//TCPClient 连接池，维护到一组服务器的连接并按策略分配写入
+//节点断开或出错后暂时移出，重连成功后自动加回
+type ClientPool struct {
+	balance       int
+	nodes         []*poolNode
+	ring          []uint32             //一致性哈希环，有序
+	ringNodes     map[uint32]*poolNode //哈希值对应的节点
+	next          uint64               //轮询计数
+	lock          *sync.RWMutex
+	protoType     int
+	heartDuration int
+	heartPage     []byte
+	dialer        Dialer
+	OnConnect     func(addr string) //节点连接成功，包括重连
+	OnClose       func(addr string)
+	OnError       func(addr string, err error)
+	OnData        func(addr string, data []byte)
+}
+
+//创建连接池，balance 为负载均衡策略
+func NewClientPool(balance int) *ClientPool {
+	return &ClientPool{
+		balance:       balance,
+		ringNodes:     make(map[uint32]*poolNode),
+		lock:          new(sync.RWMutex),
+		heartDuration: 20,
+		heartPage:     make([]byte, 0),
+		OnConnect:     func(addr string) {},
+		OnClose:       func(addr string) {},
+		OnError:       func(addr string, err error) {},
+		OnData:        func(addr string, data []byte) {},
+	}
+}
+
+//设置事件回调
+func (self *ClientPool) On(key string, backfn interface{}) {
+	if backfn == nil {
+		return
+	}
+	switch strings.ToLower(key) {
+	case "connect":
+		if fn, ok := backfn.(func(addr string)); ok {
+			self.OnConnect = fn
+		}
+	case "close":
+		if fn, ok := backfn.(func(addr string)); ok {
+			self.OnClose = fn
+		}
+	case "error":
+		if fn, ok := backfn.(func(addr string, err error)); ok {
+			self.OnError = fn
+		}
+	case "data":
+		if fn, ok := backfn.(func(addr string, data []byte)); ok {
+			self.OnData = fn
+		}
+	}
+}
+
+//设置分包协议，需在 Add 之前调用
+func (self *ClientPool) SetProto(protoType int) {
+	self.protoType = protoType
+}
+
+//设置心跳间隔和心跳包，需在 Add 之前调用
+func (self *ClientPool) SetKeepAlive(second int, data []byte) {
+	self.heartDuration = second
+	self.heartPage = data
+}
+
+//设置节点使用的拨号器，需在 Add 之前调用
+func (self *ClientPool) SetDialer(dialer Dialer) {
+	self.dialer = dialer
+}
+
+//添加节点并连接，连接失败时节点保留并在后台重连，成功后加入负载均衡
+func (self *ClientPool) Add(addr string) error {
+	self.lock.Lock()
+	for _, node := range self.nodes {
+		if node.addr == addr {
+			self.lock.Unlock()
+			return nil
+		}
+	}
+	node := &poolNode{addr: addr, client: NewTCPClient()}
+	self.nodes = append(self.nodes, node)
+	self.addRing(node)
+	self.lock.Unlock()
+
+	client := node.client
+	client.SetProto(self.protoType)
+	client.SetKeepAlive(self.heartDuration, self.heartPage)
+	if self.dialer != nil {
+		client.SetDialer(self.dialer)
+	}
+	//通过 Events 监听，不替换客户端的 OnXxx，Pick 返回的客户端上注册的监听器同样有效
+	client.Events.Connect.Add(func() {
+		atomic.StoreInt64(&node.pending, 0)
+		atomic.StoreInt32(&node.healthy, 1)
+		self.OnConnect(addr)
+	})
+	client.Events.Close.Add(func() {
+		atomic.StoreInt32(&node.healthy, 0)
+		self.OnClose(addr)
+	})
+	client.Events.Error.Add(func(err error) {
+		atomic.StoreInt32(&node.healthy, 0)
+		self.OnError(addr, err)
+	})
+	client.Events.Data.Add(func(data []byte) {
+		if atomic.AddInt64(&node.pending, -1) < 0 {
+			atomic.StoreInt64(&node.pending, 0)
+		}
+		//出错后连接仍在收数据，说明错误不影响连接，恢复可用
+		atomic.StoreInt32(&node.healthy, 1)
+		self.OnData(addr, data)
+	})
+	return client.ConnectAddrs(addr)
+}
+
+//移除节点并关闭连接
+func (self *ClientPool) Remove(addr string) {
+	self.lock.Lock()
+	var removed *poolNode
+	for i, node := range self.nodes {
+		if node.addr == addr {
+			removed = node
+			self.nodes = append(self.nodes[:i], self.nodes[i+1:]...)
+			break
+		}
+	}
+	if removed != nil {
+		self.buildRing()
+	}
+	self.lock.Unlock()
+	if removed != nil {
+		atomic.StoreInt32(&removed.healthy, 0)
+		removed.client.Close()
+	}
+}
+
+//把节点的虚拟节点加入哈希环
+func (self *ClientPool) addRing(node *poolNode) {
+	for i := 0; i < POOL_HASH_REPLICAS; i++ {
+		hash := crc32.ChecksumIEEE([]byte(node.addr + "#" + strconv.Itoa(i)))
+		if _, ok := self.ringNodes[hash]; ok {
+			continue
+		}
+		self.ringNodes[hash] = node
+		self.ring = append(self.ring, hash)
+	}
+	sort.Slice(self.ring, func(i, j int) bool { return self.ring[i] < self.ring[j] })
+}
+
+//节点移除后重建哈希环
+func (self *ClientPool) buildRing() {
+	self.ring = self.ring[:0]
+	self.ringNodes = make(map[uint32]*poolNode, len(self.nodes)*POOL_HASH_REPLICAS)
+	for _, node := range self.nodes {
+		self.addRing(node)
+	}
+}
+
+//按策略选出一个可用节点，BALANCE_HASH 时按 key 选择
+func (self *ClientPool) pick(key string) *poolNode {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if len(self.nodes) == 0 {
+		return nil
+	}
+	switch self.balance {
+	case BALANCE_LEAST_PENDING:
+		var best *poolNode
+		for _, node := range self.nodes {
+			if node.isHealthy() && (best == nil || atomic.LoadInt64(&node.pending) < atomic.LoadInt64(&best.pending)) {
+				best = node
+			}
+		}
+		return best
+	case BALANCE_HASH:
+		//顺时针找到第一个可用的节点，不可用节点的key会暂时落到下一个节点
+		hash := crc32.ChecksumIEEE([]byte(key))
+		start := sort.Search(len(self.ring), func(i int) bool { return self.ring[i] >= hash })
+		for i := 0; i < len(self.ring); i++ {
+			if node := self.ringNodes[self.ring[(start+i)%len(self.ring)]]; node.isHealthy() {
+				return node
+			}
+		}
+		return nil
+	default:
+		n := atomic.AddUint64(&self.next, 1)
+		for i := 0; i < len(self.nodes); i++ {
+			if node := self.nodes[(n+uint64(i))%uint64(len(self.nodes))]; node.isHealthy() {
+				return node
+			}
+		}
+		return nil
+	}
+}
+
+//写入节点，失败时把节点标记为不可用并断开连接，重连成功后恢复
+func (self *ClientPool) write(node *poolNode, data []byte) (int, error) {
+	if node == nil {
+		return 0, ErrNoNode
+	}
+	atomic.AddInt64(&node.pending, 1)
+	n, err := node.client.Write(data)
+	if err != nil {
+		atomic.AddInt64(&node.pending, -1)
+		atomic.StoreInt32(&node.healthy, 0)
+		node.client.drop()
+	}
+	return n, err
+}
+
+//按策略选节点写入，BALANCE_HASH 时等同于 WriteKey("", data)
+func (self *ClientPool) Write(data []byte) (int, error) {
+	return self.write(self.pick(""), data)
+}
+
+//按 key 选节点写入，只有 BALANCE_HASH 策略使用 key
+func (self *ClientPool) WriteKey(key string, data []byte) (int, error) {
+	return self.write(self.pick(key), data)
+}
+
+//按策略选出的客户端，没有可用节点时返回nil
+func (self *ClientPool) Pick(key string) *TCPClient {
+	if node := self.pick(key); node != nil {
+		return node.client
+	}
+	return nil
+}
+
+//所有节点地址
+func (self *ClientPool) Addrs() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	addrs := make([]string, 0, len(self.nodes))
+	for _, node := range self.nodes {
+		addrs = append(addrs, node.addr)
+	}
+	return addrs
+}
+
+//当前可用的节点地址
+func (self *ClientPool) Healthy() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	addrs := make([]string, 0, len(self.nodes))
+	for _, node := range self.nodes {
+		if node.isHealthy() {
+			addrs = append(addrs, node.addr)
+		}
+	}
+	return addrs
+}
+
+//关闭所有连接
+func (self *ClientPool) Close() {
+	self.lock.Lock()
+	nodes := self.nodes
+	self.nodes = nil
+	self.buildRing()
+	self.lock.Unlock()
+	for _, node := range nodes {
+		atomic.StoreInt32(&node.healthy, 0)
+		node.client.Close()
+	}
+}
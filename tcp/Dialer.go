@@ -0,0 +1,235 @@
+package tcp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DIAL_TIMEOUT = 10 * time.Second //默认拨号超时
+)
+
+var (
+	ErrSocksVersion = errors.New("socks5: bad version")
+	ErrSocksAuth    = errors.New("socks5: authentication failed")
+	ErrSocksMethod  = errors.New("socks5: no acceptable auth method")
+)
+
+//拨号器，TCPClient 通过它建立连接，可以替换成代理或其它传输方式
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+//直连拨号器
+type DirectDialer struct {
+	Timeout   time.Duration //拨号超时，0 不限制
+	LocalAddr net.Addr      //绑定的本地地址，nil 由系统选择
+}
+
+func (self *DirectDialer) Dial(network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: self.Timeout, LocalAddr: self.LocalAddr}
+	return d.Dial(network, addr)
+}
+
+//未指定上一级拨号器时直连代理服务器
+func forwardDialer(forward Dialer, timeout time.Duration) Dialer {
+	if forward != nil {
+		return forward
+	}
+	return &DirectDialer{Timeout: timeout}
+}
+
+//SOCKS5 代理拨号器，Username 不为空时使用用户名密码认证(RFC 1929)
+type SOCKS5Dialer struct {
+	ProxyAddr string
+	Username  string
+	Password  string
+	Timeout   time.Duration //连接代理和握手的总超时，0 不限制
+	Forward   Dialer        //连接代理服务器使用的拨号器，nil 为直连，可用于代理链
+}
+
+func (self *SOCKS5Dialer) Dial(network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xFFFF {
+		return nil, fmt.Errorf("socks5: bad port %q", portStr)
+	}
+	conn, err := forwardDialer(self.Forward, self.Timeout).Dial("tcp", self.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if self.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(self.Timeout))
+	}
+	if err = self.handshake(conn, host, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (self *SOCKS5Dialer) handshake(conn net.Conn, host string, port int) error {
+	//协商认证方式
+	methods := []byte{0x00}
+	if self.Username != "" {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return ErrSocksVersion
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if self.Username == "" {
+			return ErrSocksMethod
+		}
+		if len(self.Username) > 255 || len(self.Password) > 255 {
+			return ErrSocksAuth
+		}
+		req := []byte{0x01, byte(len(self.Username))}
+		req = append(req, self.Username...)
+		req = append(req, byte(len(self.Password)))
+		req = append(req, self.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return ErrSocksAuth
+		}
+	default:
+		return ErrSocksMethod
+	}
+	//CONNECT 请求，域名交给代理解析
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5: host too long")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	//应答: VER REP RSV ATYP BND.ADDR BND.PORT
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[0] != 0x05 {
+		return ErrSocksVersion
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socks5: connect failed, code %d", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, head[:1]); err != nil {
+			return err
+		}
+		skip = int(head[0])
+	default:
+		return fmt.Errorf("socks5: bad address type %d", head[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+//HTTP CONNECT 代理拨号器，Username 不为空时使用 Basic 认证
+type HTTPConnectDialer struct {
+	ProxyAddr string
+	Username  string
+	Password  string
+	Header    http.Header   //附加的请求头
+	Timeout   time.Duration //连接代理和握手的总超时，0 不限制
+	Forward   Dialer        //连接代理服务器使用的拨号器，nil 为直连
+}
+
+func (self *HTTPConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := forwardDialer(self.Forward, self.Timeout).Dial("tcp", self.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if self.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(self.Timeout))
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	for key, vals := range self.Header {
+		req.Header[key] = vals
+	}
+	if self.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(self.Username + ":" + self.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http connect: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	//代理可能在应答后紧跟着发来了服务器的数据
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+//先读完缓冲区中剩余数据的连接
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (self *bufferedConn) Read(b []byte) (int, error) {
+	return self.reader.Read(b)
+}
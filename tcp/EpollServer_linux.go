@@ -0,0 +1,204 @@
+//go:build linux
+
+package tcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+const (
+	EPOLL_EVENTS   = 256       //单次等待返回的最大事件数
+	EPOLL_READ_BUF = 16 * 1024 //共享读缓冲大小
+)
+
+var errNoFd = errors.New("conn has no file descriptor")
+
+//epoll事件循环，一个 epoller 管理一批连接，空闲连接不占用协程
+type epoller struct {
+	fd      int
+	server  *TCPServer
+	clients map[int]*epollConn
+	lock    *sync.RWMutex
+}
+
+//注册到epoll的连接，通过 RawConn 直接读文件描述符，不经过Go的网络轮询器阻塞事件循环协程
+type epollConn struct {
+	client *Client
+	raw    syscall.RawConn
+}
+
+func newEpoller(server *TCPServer) (*epoller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epoller{
+		fd:      fd,
+		server:  server,
+		clients: make(map[int]*epollConn),
+		lock:    new(sync.RWMutex),
+	}, nil
+}
+
+//获取连接的文件描述符
+func connFd(conn net.Conn) (int, syscall.RawConn, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, nil, errNoFd
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, nil, err
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, nil, err
+	}
+	return fd, raw, nil
+}
+
+//注册连接
+func (self *epoller) add(client *Client) error {
+	fd, raw, err := connFd(client.conn)
+	if err != nil {
+		return err
+	}
+	client.closeHook = func() { self.remove(fd) }
+	self.lock.Lock()
+	self.clients[fd] = &epollConn{client: client, raw: raw}
+	self.lock.Unlock()
+	event := &syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(fd)}
+	if err := syscall.EpollCtl(self.fd, syscall.EPOLL_CTL_ADD, fd, event); err != nil {
+		self.remove(fd)
+		return err
+	}
+	return nil
+}
+
+//移除连接，必须在关闭连接之前调用，避免文件描述符被复用后误删
+func (self *epoller) remove(fd int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.clients[fd]; !ok {
+		return
+	}
+	delete(self.clients, fd)
+	syscall.EpollCtl(self.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+//等待可读事件并分发
+func (self *epoller) wait() {
+	events := make([]syscall.EpollEvent, EPOLL_EVENTS)
+	for {
+		n, err := syscall.EpollWait(self.fd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			logger.Error("epoll等待异常:", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			self.lock.RLock()
+			conn := self.clients[int(events[i].Fd)]
+			self.lock.RUnlock()
+			if conn != nil {
+				self.read(conn)
+			}
+		}
+	}
+}
+
+//连接可读时从共享缓冲池取缓冲读取一次，交给协议拆包
+//非阻塞地直接读文件描述符，没有数据(EAGAIN)时立即返回，不会让事件循环协程停在某个连接上
+func (self *epoller) read(conn *epollConn) {
+	client := conn.client
+	bufp := GetBuf(EPOLL_READ_BUF)
+	defer PutBuf(bufp)
+	var n int
+	var rerr error
+	err := conn.raw.Read(func(fd uintptr) bool {
+		for {
+			n, rerr = syscall.Read(int(fd), *bufp)
+			if rerr != syscall.EINTR {
+				return true
+			}
+		}
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err == syscall.EAGAIN {
+		return
+	}
+	if err != nil || n <= 0 {
+		if !client.closed() && client.notifyClose() {
+			logger.Debug(client.conn.RemoteAddr(), "连接异常!", err)
+			client.Close()
+			if err == nil || err == io.EOF {
+				self.server.OnClose(client)
+			} else {
+				self.server.OnError(client, err)
+			}
+		}
+		return
+	}
+	client.proto.SplitPackage(client, (*bufp)[:n])
+}
+
+//以epoll事件循环模式开启监听，适合大量空闲连接的场景
+//连接数据由事件循环协程回调，回调中不要做耗时操作，OnData 的 data 只在回调期间有效
+//epoll模式不经过 net.Conn 读取，Client.SetTimeout 设置的读超时不生效，空闲检测需要业务自行实现
+func (ser *TCPServer) ListenEpoll(addr *net.TCPAddr) bool {
+	listener, err := ser.listenTCP(addr)
+	if err != nil {
+		return false
+	}
+	pollers := make([]*epoller, runtime.NumCPU())
+	for i := range pollers {
+		if pollers[i], err = newEpoller(ser); err != nil {
+			logger.Error("创建epoll失败:", err)
+			listener.Close()
+			return false
+		}
+		go pollers[i].wait()
+	}
+	ser.setListener(listener)
+	ser.OnStart(ser.addr.Port)
+	serve := func(i int, conn net.Conn) {
+		client := newClient(conn, ser, false)
+		ser.OnConnect(client)
+		if client.closed() {
+			return
+		}
+		if err := pollers[i%len(pollers)].add(client); err != nil {
+			logger.Error("注册epoll失败:", err)
+			client.Close()
+			ser.OnError(client, err)
+		}
+	}
+	i := 0
+	for _, conn := range takeInheritedConns() {
+		serve(i, conn)
+		i++
+	}
+	for ; ; i++ {
+		conn, err := ser.listener.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				ser.waitDrain()
+				return true
+			}
+			logger.Debug("accept err", err)
+			continue
+		}
+		serve(i, conn)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tcp
+
+import (
+	"net"
+)
+
+//非linux系统不支持epoll，退化为每连接一个协程的模式
+func (ser *TCPServer) ListenEpoll(addr *net.TCPAddr) bool {
+	return ser.Listen(addr)
+}
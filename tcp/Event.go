@@ -0,0 +1,194 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+var (
+	ErrEventKey  = errors.New("unknown event")
+	ErrEventFunc = errors.New("event handler signature mismatch")
+)
+
+//监听器 panic 后的回调，默认打印日志和调用栈，panic 不会影响其它监听器和连接的读协程
+var OnEventPanic = func(err interface{}, stack []byte) {
+	logger.Error("事件回调异常:", err, "\n", string(stack))
+}
+
+func eventFuncError(key string, backfn interface{}) error {
+	return fmt.Errorf("%w: %s %T", ErrEventFunc, key, backfn)
+}
+
+func recoverEvent() {
+	if err := recover(); err != nil {
+		OnEventPanic(err, debug.Stack())
+	}
+}
+
+type listener[F any] struct {
+	id    uint64
+	order int
+	fn    F
+}
+
+//监听器列表，写时复制，回调时不加锁
+type event[F any] struct {
+	list atomic.Value //[]listener[F]
+	lock sync.Mutex
+	seq  uint64
+}
+
+func (self *event[F]) load() []listener[F] {
+	list, _ := self.list.Load().([]listener[F])
+	return list
+}
+
+func (self *event[F]) add(order int, fn F) func() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.seq++
+	id := self.seq
+	old := self.load()
+	list := make([]listener[F], len(old), len(old)+1)
+	copy(list, old)
+	list = append(list, listener[F]{id: id, order: order, fn: fn})
+	//order 小的先回调，相同的按注册顺序
+	sort.SliceStable(list, func(i, j int) bool { return list[i].order < list[j].order })
+	self.list.Store(list)
+	return func() { self.remove(id) }
+}
+
+func (self *event[F]) remove(id uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	old := self.load()
+	list := make([]listener[F], 0, len(old))
+	for _, l := range old {
+		if l.id != id {
+			list = append(list, l)
+		}
+	}
+	self.list.Store(list)
+}
+
+//监听器数量
+func (self *event[F]) Len() int {
+	return len(self.load())
+}
+
+//On 注册的监听器，同一事件再次调用 On 时替换上一次注册的，和原来直接赋值回调的行为一致
+type onListeners struct {
+	remove map[string]func()
+	lock   sync.Mutex
+}
+
+func (self *onListeners) replace(key string, remove func()) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if old := self.remove[key]; old != nil {
+		old()
+	}
+	if self.remove == nil {
+		self.remove = make(map[string]func())
+	}
+	self.remove[key] = remove
+}
+
+//无参数的事件
+type Event0 struct {
+	event[func()]
+}
+
+//注册监听器，返回的函数用于注销
+func (self *Event0) Add(fn func()) func() {
+	return self.add(0, fn)
+}
+
+//按顺序注册监听器，order 小的先回调，默认为0
+func (self *Event0) AddOrder(order int, fn func()) func() {
+	return self.add(order, fn)
+}
+
+func (self *Event0) Emit() {
+	for _, l := range self.load() {
+		call0(l.fn)
+	}
+}
+
+func call0(fn func()) {
+	defer recoverEvent()
+	fn()
+}
+
+//一个参数的事件
+type Event1[A any] struct {
+	event[func(A)]
+}
+
+func (self *Event1[A]) Add(fn func(A)) func() {
+	return self.add(0, fn)
+}
+
+func (self *Event1[A]) AddOrder(order int, fn func(A)) func() {
+	return self.add(order, fn)
+}
+
+func (self *Event1[A]) Emit(a A) {
+	for _, l := range self.load() {
+		call1(l.fn, a)
+	}
+}
+
+func call1[A any](fn func(A), a A) {
+	defer recoverEvent()
+	fn(a)
+}
+
+//两个参数的事件
+type Event2[A, B any] struct {
+	event[func(A, B)]
+}
+
+func (self *Event2[A, B]) Add(fn func(A, B)) func() {
+	return self.add(0, fn)
+}
+
+func (self *Event2[A, B]) AddOrder(order int, fn func(A, B)) func() {
+	return self.add(order, fn)
+}
+
+func (self *Event2[A, B]) Emit(a A, b B) {
+	for _, l := range self.load() {
+		call2(l.fn, a, b)
+	}
+}
+
+func call2[A, B any](fn func(A, B), a A, b B) {
+	defer recoverEvent()
+	fn(a, b)
+}
+
+//服务器事件
+type ServerEvents struct {
+	Start   Event1[int]
+	Connect Event1[*Client]
+	Error   Event2[*Client, error]
+	Data    Event2[*Client, []byte]
+	Close   Event1[*Client]
+}
+
+//客户端事件
+type ClientEvents struct {
+	Connect   Event0
+	Close     Event0
+	Error     Event1[error]
+	Data      Event1[[]byte]
+	Negotiate Event1[*Codec]
+	Resume    Event1[bool]
+}
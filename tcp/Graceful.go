@@ -0,0 +1,163 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+const (
+	GRACEFUL_ENV   = "TCP_GRACEFUL_FDS"     //新进程从这个环境变量得知继承的文件描述符，逗号分隔，第一个为监听，其余为连接
+	DRAIN_INTERVAL = 100 * time.Millisecond //等待连接关闭的检查间隔
+)
+
+var (
+	ErrNotListening        = errors.New("server is not listening")
+	ErrGracefulUnsupported = errors.New("graceful restart is not supported on this platform")
+)
+
+//平滑重启的状态，Restart 后旧进程停止接受连接，Drain 结束后 Listen 返回
+type gracefulState struct {
+	lock       sync.Mutex //保护 TCPServer.listener，Restart 在信号协程中读取
+	restarting int32
+	drained    chan struct{}
+	closed     int32
+}
+
+func newGracefulState() *gracefulState {
+	return &gracefulState{drained: make(chan struct{})}
+}
+
+//监听地址，有继承自旧进程的监听时直接使用，忽略 addr
+func (ser *TCPServer) listenTCP(addr *net.TCPAddr) (*net.TCPListener, error) {
+	if listener := takeInheritedListener(); listener != nil {
+		logger.Info("继承旧进程的监听:", listener.Addr())
+		return listener, nil
+	}
+	return net.ListenTCP("tcp", addr)
+}
+
+func (ser *TCPServer) setListener(listener *net.TCPListener) {
+	ser.graceful.lock.Lock()
+	defer ser.graceful.lock.Unlock()
+	ser.listener = listener
+	ser.addr = listener.Addr().(*net.TCPAddr)
+}
+
+func (ser *TCPServer) getListener() *net.TCPListener {
+	ser.graceful.lock.Lock()
+	defer ser.graceful.lock.Unlock()
+	return ser.listener
+}
+
+//Listen 的 accept 循环退出后，重启中的旧进程等待连接排空
+func (ser *TCPServer) waitDrain() {
+	if atomic.LoadInt32(&ser.graceful.restarting) == 1 {
+		<-ser.graceful.drained
+	}
+}
+
+//收到 sig 时平滑重启：启动新进程接管监听，handoff 为true时把空闲连接一并移交，
+//旧进程不再接受新连接，等待剩余连接在 timeout 内关闭后退出
+//例如 ser.RestartOn(syscall.SIGUSR2, true, time.Minute)，升级时替换可执行文件后 kill -USR2 <pid>
+func (ser *TCPServer) RestartOn(sig os.Signal, handoff bool, timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	go func() {
+		for range ch {
+			process, err := ser.Restart(handoff)
+			if err != nil {
+				logger.Error("平滑重启失败:", err)
+				continue
+			}
+			signal.Stop(ch)
+			logger.Info("新进程已启动:", process.Pid, "等待连接关闭")
+			if n := ser.Drain(timeout); n > 0 {
+				logger.Info("排空超时，强制关闭连接数:", n)
+			}
+			os.Exit(0)
+		}
+	}()
+}
+
+//等待在线连接关闭，timeout 后关闭剩余的连接，返回强制关闭的连接数
+//重启后调用，Drain 返回后 Listen 随之返回
+func (ser *TCPServer) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for ser.NumClients() > 0 && time.Now().Before(deadline) {
+		time.Sleep(DRAIN_INTERVAL)
+	}
+	clients := ser.Clients()
+	for _, client := range clients {
+		client.Kick()
+	}
+	if atomic.CompareAndSwapInt32(&ser.graceful.closed, 0, 1) {
+		close(ser.graceful.drained)
+	}
+	return len(clients)
+}
+
+//停止读取并取出连接的文件描述符，用于移交给新进程
+//只移交每连接一个协程模式下的空闲TCP连接：没有半截包、未协商编解码、未开启会话恢复
+//连接的属性、房间等状态不随连接移交，新进程中按新连接回调 OnConnect
+func (self *Client) detach() (*os.File, bool) {
+	tcpconn, ok := self.conn.(*net.TCPConn)
+	done := self.readDone()
+	if !ok || done == nil || self.closed() || self.Session() != nil || self.Codec() != defaultCodec {
+		return nil, false
+	}
+	atomic.StoreInt32(&self.handoff, 1)
+	//唤醒阻塞在 Read 上的读循环，读循环看到 handoff 标记后直接退出
+	tcpconn.SetReadDeadline(time.Now())
+	<-done
+	if !self.idle() {
+		self.resume()
+		return nil, false
+	}
+	file, err := tcpconn.File()
+	if err != nil {
+		logger.Error(self.RemoteAddr(), "取连接文件描述符失败:", err)
+		self.resume()
+		return nil, false
+	}
+	return file, true
+}
+
+//移交失败时恢复读取
+func (self *Client) resume() {
+	atomic.StoreInt32(&self.handoff, 0)
+	if self.closed() {
+		return
+	}
+	self.conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	self.doneLock.Lock()
+	self.done = done
+	self.doneLock.Unlock()
+	go self.serve(done)
+}
+
+//当前读循环的结束通知，epoll模式为nil
+func (self *Client) readDone() chan struct{} {
+	self.doneLock.Lock()
+	defer self.doneLock.Unlock()
+	return self.done
+}
+
+func (self *Client) handingOff() bool {
+	return atomic.LoadInt32(&self.handoff) == 1
+}
+
+//协议缓存中没有半截包
+func (self *Client) idle() bool {
+	if proto, ok := self.proto.(interface{ pending() int }); ok {
+		return proto.pending() == 0
+	}
+	return false
+}
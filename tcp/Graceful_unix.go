@@ -0,0 +1,167 @@
+//go:build !windows
+
+package tcp
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+//从旧进程继承的监听和连接，只被第一次 Listen 取走
+var inherited struct {
+	once     sync.Once
+	lock     sync.Mutex
+	listener *net.TCPListener
+	conns    []net.Conn
+}
+
+func loadInherited() {
+	val, ok := os.LookupEnv(GRACEFUL_ENV)
+	if !ok {
+		return
+	}
+	//不再传给本进程启动的其它子进程
+	os.Unsetenv(GRACEFUL_ENV)
+	fds, err := parseFds(val)
+	if err != nil || len(fds) == 0 {
+		logger.Error("继承的文件描述符有误:", val)
+		return
+	}
+	file := os.NewFile(fds[0], "graceful-listener")
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		logger.Error("继承监听失败:", err)
+		return
+	}
+	tcplistener, ok := listener.(*net.TCPListener)
+	if !ok {
+		listener.Close()
+		return
+	}
+	inherited.listener = tcplistener
+	for _, fd := range fds[1:] {
+		file := os.NewFile(fd, "graceful-conn")
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			logger.Error("继承连接失败:", err)
+			continue
+		}
+		inherited.conns = append(inherited.conns, conn)
+	}
+}
+
+//解析逗号分隔的文件描述符
+func parseFds(val string) ([]uintptr, error) {
+	var fds []uintptr
+	for _, item := range strings.Split(val, ",") {
+		fd, err := strconv.ParseUint(item, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, uintptr(fd))
+	}
+	return fds, nil
+}
+
+//子进程中的文件描述符，ExtraFiles 的第i个文件为 3+i
+func formatFds(n int) string {
+	fds := make([]string, n)
+	for i := range fds {
+		fds[i] = strconv.Itoa(3 + i)
+	}
+	return strings.Join(fds, ",")
+}
+
+func takeInheritedListener() *net.TCPListener {
+	inherited.once.Do(loadInherited)
+	inherited.lock.Lock()
+	defer inherited.lock.Unlock()
+	listener := inherited.listener
+	inherited.listener = nil
+	return listener
+}
+
+//继承的连接，在取走监听之后调用
+func takeInheritedConns() []net.Conn {
+	inherited.once.Do(loadInherited)
+	inherited.lock.Lock()
+	defer inherited.lock.Unlock()
+	conns := inherited.conns
+	inherited.conns = nil
+	return conns
+}
+
+//以相同的参数启动新进程并把监听传给它，handoff 为true时同时移交空闲连接
+//新进程启动后本进程停止接受新连接，随后应调用 Drain 等待剩余连接关闭
+//新进程的 Listen/ListenEpoll 会直接使用继承的监听，不需要改动启动代码，ListenEpoll 模式的连接不移交，只等待排空
+//在 util.Supervisor 守护的子进程中调用时，需把返回的进程交给 util.SupervisorHandoff，否则守护进程把本进程的退出当作停止，新进程无人守护
+//不经过 Supervisor 直接由 systemd(Type=simple) 启动时，本进程退出会结束整个服务，需要配合 Supervisor 使用
+func (ser *TCPServer) Restart(handoff bool) (*os.Process, error) {
+	listener := ser.getListener()
+	if listener == nil {
+		return nil, ErrNotListening
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	listenerFile, err := listener.File()
+	if err != nil {
+		return nil, err
+	}
+	defer listenerFile.Close()
+	files := []*os.File{listenerFile}
+	var detached []*Client
+	if handoff {
+		for _, client := range ser.Clients() {
+			if file, ok := client.detach(); ok {
+				files = append(files, file)
+				detached = append(detached, client)
+			}
+		}
+	}
+	defer func() {
+		for _, file := range files[1:] {
+			file.Close()
+		}
+	}()
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(gracefulEnviron(), GRACEFUL_ENV+"="+formatFds(len(files)))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		for _, client := range detached {
+			client.resume()
+		}
+		return nil, err
+	}
+	//连接已由新进程接管，这里只释放本进程的副本，不回调 OnClose
+	for _, client := range detached {
+		client.Close()
+	}
+	atomic.StoreInt32(&ser.graceful.restarting, 1)
+	listener.Close()
+	logger.Info("移交监听和连接数:", len(detached))
+	return cmd.Process, nil
+}
+
+//去掉已有的 GRACEFUL_ENV，本进程也可能是继承启动的
+func gracefulEnviron() []string {
+	env := os.Environ()
+	out := env[:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, GRACEFUL_ENV+"=") {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package tcp
+
+import (
+	"net"
+	"os"
+)
+
+//windows 不支持通过文件描述符继承监听，没有可继承的监听和连接
+func takeInheritedListener() *net.TCPListener {
+	return nil
+}
+
+func takeInheritedConns() []net.Conn {
+	return nil
+}
+
+//windows 不支持平滑重启
+func (ser *TCPServer) Restart(handoff bool) (*os.Process, error) {
+	return nil, ErrGracefulUnsupported
+}
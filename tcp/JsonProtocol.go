@@ -31,13 +31,19 @@ func NewJsonProto(OnData func(conn *Client, data []byte), OnClose func(conn *Cli
 //读取数据
 func (self *JsonProto) Read(client *Client) {
 	control := true
-	readbuf := make([]byte, JSON_RECV_BUF_LEN)
+	bufp := GetBuf(JSON_RECV_BUF_LEN)
+	defer PutBuf(bufp)
+	readbuf := *bufp
 	//clientAddr := client.conn.RemoteAddr()
 	for control {
 		n, err := client.conn.Read(readbuf)
 		if err != nil {
 			control = false
-			if !client.isClosed {
+			if client.handingOff() {
+				//连接正在移交给新进程，不关闭
+				break
+			}
+			if !client.closed() && client.notifyClose() {
 				//fmt.Println(clientAddr, "连接异常!", err)
 				//关闭并释放资源，否则服务器会有CLOSE_WAIT出现，客户端会员 FIN_WAIT2
 				client.Close()
@@ -52,7 +58,7 @@ func (self *JsonProto) Read(client *Client) {
 		if n <= 0 {
 			control = false
 			fmt.Println("客户端关闭连接")
-			if !client.isClosed {
+			if !client.closed() && client.notifyClose() {
 				client.Close()
 				self.OnClose(client)
 			}
@@ -62,7 +68,12 @@ func (self *JsonProto) Read(client *Client) {
 	}
 }
 
-//拆包
+//缓存中半截包的长度
+func (self *JsonProto) pending() int {
+	return self.buf.Len()
+}
+
+//拆包，完整的包直接从 buf 中回调，只有半截包才拷贝到缓存
 func (self *JsonProto) SplitPackage(client *Client, buf []byte) {
 	k := 0
 	for i, byteval := range buf {
@@ -71,9 +82,13 @@ func (self *JsonProto) SplitPackage(client *Client, buf []byte) {
 		if byteval == 10 {
 			if i > 0 && buf[i-1] == 13 {
 				//读取到包结束符号
-				self.buf.Write(buf[k : i-1])
-				self.OnData(client, self.buf.Bytes())
-				self.buf.Truncate(0)
+				if self.buf.Len() > 0 {
+					self.buf.Write(buf[k : i-1])
+					self.OnData(client, self.buf.Bytes())
+					self.buf.Truncate(0)
+				} else {
+					self.OnData(client, buf[k:i-1])
+				}
 				k = i + 1
 			} else if i == 0 && self.buf.Len() > 0 && self.buf.Bytes()[self.buf.Len()-1] == 13 {
 				//读取到包结束符号
@@ -89,7 +104,9 @@ func (self *JsonProto) SplitPackage(client *Client, buf []byte) {
 		//包过大
 		if int64(self.buf.Len()) > JSON_MAX_BUF {
 			client.Close()
-			self.OnError(client, TO_LAGER)
+			if client.notifyClose() {
+				self.OnError(client, TO_LAGER)
+			}
 		}
 		//fmt.Println("半截包内容:", string(client.Allbuf.Bytes()))
 	}
@@ -0,0 +1,920 @@
+package tcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+//可靠UDP的段类型
+const (
+	KCP_CMD_PUSH byte = 81 //数据
+	KCP_CMD_ACK  byte = 82 //确认，每个收到的数据段单独确认(选择确认)
+	KCP_CMD_WASK byte = 83 //询问对端接收窗口
+	KCP_CMD_WINS byte = 84 //告知本端接收窗口
+	KCP_CMD_FIN  byte = 85 //关闭，Sn 为发出的数据段总数
+	KCP_CMD_SYN  byte = 86 //拨号后通知服务器建立连接，客户端不发数据也能被 Accept
+)
+
+const (
+	KCP_HEAD_LEN  = 21   //段头 conv(4)|cmd(1)|wnd(2)|sn(4)|una(4)|ts(4)|len(2)
+	KCP_MTU       = 1400 //单个数据报的最大长度
+	KCP_WND       = 128  //默认收发窗口(段数)
+	KCP_INTERVAL  = 40 * time.Millisecond
+	KCP_DEAD_LINK = 20  //单个段重发次数超过后认为连接断开
+	KCP_RTO_DEF   = 200 //初始重发超时(毫秒)
+	KCP_RTO_MIN   = 100 //普通模式最小重发超时(毫秒)
+	KCP_RTO_NDL   = 30  //nodelay 模式最小重发超时(毫秒)
+	KCP_RTO_MAX   = 60000
+	KCP_PROBE     = 1000             //对端窗口为0时的探测间隔(毫秒)
+	KCP_LINGER    = 5 * time.Second  //关闭后等待未确认数据发完的最长时间
+	KCP_FIN_TIMES = 3                //关闭包不重发，多发几次
+	KCP_SYN_TIMES = 3                //建立连接的包不重发，多发几次
+	KCP_IDLE      = 30 * time.Second //收不到对端任何数据超过这个时间认为对端已死
+	KCP_BACKLOG   = 128
+)
+
+var (
+	ErrKCPDead    = errors.New("kcp: dead link")
+	errKCPTimeout = &timeoutError{}
+)
+
+//可靠UDP的参数，零值字段使用默认值
+type KCPConfig struct {
+	SndWnd       int           //发送窗口(段数)
+	RcvWnd       int           //接收窗口(段数)
+	MTU          int           //单个数据报的最大长度
+	NoDelay      bool          //nodelay 模式：更小的最小RTO，超时后RTO按1.5倍而不是2倍增长，写入和收包后立即发送
+	Interval     time.Duration //内部刷新间隔
+	Resend       int           //快速重传阈值，被跳过多少次确认后立即重发，0 关闭
+	NoCongestion bool          //关闭拥塞控制，只受收发窗口限制
+	DeadLink     int           //单个段最多发送次数
+	IdleTimeout  time.Duration //收不到对端数据超过这个时间关闭连接，空闲时每 1/3 超时时间发一次探测保活
+	LossRate     float64       //模拟丢包率(0~1)，只用于测试
+}
+
+//普通模式的参数
+func DefaultKCPConfig() *KCPConfig {
+	return &KCPConfig{SndWnd: KCP_WND, RcvWnd: KCP_WND, MTU: KCP_MTU, Interval: KCP_INTERVAL, DeadLink: KCP_DEAD_LINK}
+}
+
+//低延迟模式的参数，适合实时游戏：nodelay、10ms刷新、2次跳过确认快速重传、关闭拥塞控制
+func FastKCPConfig() *KCPConfig {
+	return &KCPConfig{SndWnd: KCP_WND, RcvWnd: KCP_WND, MTU: KCP_MTU, NoDelay: true, Interval: 10 * time.Millisecond,
+		Resend: 2, NoCongestion: true, DeadLink: KCP_DEAD_LINK}
+}
+
+//填充默认值
+func (self *KCPConfig) normalize() KCPConfig {
+	config := *DefaultKCPConfig()
+	if self != nil {
+		config = *self
+	}
+	if config.SndWnd <= 0 {
+		config.SndWnd = KCP_WND
+	}
+	if config.RcvWnd <= 0 {
+		config.RcvWnd = KCP_WND
+	}
+	if config.MTU <= KCP_HEAD_LEN {
+		config.MTU = KCP_MTU
+	}
+	if config.Interval <= 0 {
+		config.Interval = KCP_INTERVAL
+	}
+	if config.DeadLink <= 0 {
+		config.DeadLink = KCP_DEAD_LINK
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = KCP_IDLE
+	}
+	return config
+}
+
+//发送中的数据段
+type kcpSegment struct {
+	sn       uint32
+	ts       uint32
+	resendts uint32
+	rto      uint32
+	fastack  int
+	xmit     int
+	data     []byte
+}
+
+type kcpAck struct {
+	sn uint32
+	ts uint32
+}
+
+func timediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+//可靠UDP连接，实现 net.Conn，可以交给 TCPServer.ServeConn 或作为 TCPClient 的连接
+//数据按字节流收发，分包仍由 Protocoler 负责
+type KCPConn struct {
+	conv     uint32
+	config   KCPConfig
+	mss      int
+	local    net.Addr
+	remote   net.Addr
+	output   func(data []byte) error
+	teardown func() //连接彻底结束后释放底层资源
+	start    time.Time
+	lock     sync.Mutex
+
+	sndQueue []*kcpSegment //等待进入窗口的段
+	sndBuf   []*kcpSegment //已发出未确认的段，按 sn 有序
+	sndUna   uint32
+	sndNxt   uint32
+	rmtWnd   uint32
+	cwnd     uint32
+	ssthresh uint32
+	incr     uint32
+	rxSrtt   int32
+	rxRttval int32
+	rxRto    uint32
+
+	rcvNxt   uint32
+	rcvBuf   map[uint32][]byte //乱序到达的段
+	rcvQueue [][]byte          //按序待读取的数据
+	acklist  []kcpAck
+	finSn    uint32 //对端的关闭序号
+	finRecv  bool
+
+	probeWask bool
+	probeWins bool
+	probeTs   uint32
+	flushBuf  []byte
+	lastRecv  time.Time //最后收到对端数据的时间
+	lastPing  time.Time //最后发出保活探测的时间
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	closing    chan struct{} //用户调用了 Close
+	dead       chan struct{} //连接已彻底结束
+	closeOnce  sync.Once
+	deadOnce   sync.Once
+	err        error
+	rd         time.Time
+	wd         time.Time
+}
+
+func newKCPConn(conv uint32, config KCPConfig, local, remote net.Addr, output func(data []byte) error, teardown func()) *KCPConn {
+	self := &KCPConn{
+		conv:       conv,
+		config:     config,
+		mss:        config.MTU - KCP_HEAD_LEN,
+		local:      local,
+		remote:     remote,
+		teardown:   teardown,
+		start:      time.Now(),
+		lastRecv:   time.Now(),
+		rmtWnd:     uint32(config.RcvWnd),
+		cwnd:       1,
+		ssthresh:   2,
+		rxRto:      KCP_RTO_DEF,
+		rcvBuf:     make(map[uint32][]byte),
+		flushBuf:   make([]byte, 0, config.MTU),
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		dead:       make(chan struct{}),
+	}
+	self.output = output
+	if config.LossRate > 0 {
+		self.output = func(data []byte) error {
+			if mrand.Float64() < config.LossRate {
+				return nil
+			}
+			return output(data)
+		}
+	}
+	go self.update()
+	return self
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (self *KCPConn) current() uint32 {
+	return uint32(time.Since(self.start) / time.Millisecond)
+}
+
+//等待事件或超时，返回false表示已超时
+func waitEvent(ch, closing, dead chan struct{}, deadline time.Time) bool {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return false
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-closing:
+	case <-dead:
+	case <-timeout:
+		return false
+	}
+	return true
+}
+
+func (self *KCPConn) Read(b []byte) (int, error) {
+	for {
+		self.lock.Lock()
+		select {
+		case <-self.closing:
+			self.lock.Unlock()
+			return 0, net.ErrClosed
+		default:
+		}
+		if len(self.rcvQueue) > 0 {
+			full := len(self.rcvQueue) >= self.config.RcvWnd
+			n := 0
+			for n < len(b) && len(self.rcvQueue) > 0 {
+				m := copy(b[n:], self.rcvQueue[0])
+				n += m
+				if m < len(self.rcvQueue[0]) {
+					self.rcvQueue[0] = self.rcvQueue[0][m:]
+				} else {
+					self.rcvQueue[0] = nil
+					self.rcvQueue = self.rcvQueue[1:]
+				}
+			}
+			self.moveRcvBuf()
+			if full && len(self.rcvQueue) < self.config.RcvWnd {
+				//窗口重新打开，主动告知对端
+				self.probeWins = true
+			}
+			self.lock.Unlock()
+			return n, nil
+		}
+		if self.finRecv && timediff(self.rcvNxt, self.finSn) >= 0 {
+			self.lock.Unlock()
+			return 0, io.EOF
+		}
+		if self.err != nil {
+			err := self.err
+			self.lock.Unlock()
+			return 0, err
+		}
+		deadline := self.rd
+		self.lock.Unlock()
+		if !waitEvent(self.readEvent, self.closing, self.dead, deadline) {
+			return 0, errKCPTimeout
+		}
+	}
+}
+
+func (self *KCPConn) Write(b []byte) (int, error) {
+	n := 0
+	for {
+		self.lock.Lock()
+		select {
+		case <-self.closing:
+			self.lock.Unlock()
+			return n, net.ErrClosed
+		default:
+		}
+		if self.err != nil {
+			err := self.err
+			self.lock.Unlock()
+			return n, err
+		}
+		//发送队列超过窗口时阻塞，形成背压
+		for len(self.sndQueue) < self.config.SndWnd && n < len(b) {
+			size := len(b) - n
+			if size > self.mss {
+				size = self.mss
+			}
+			data := make([]byte, size)
+			copy(data, b[n:n+size])
+			self.sndQueue = append(self.sndQueue, &kcpSegment{data: data})
+			n += size
+		}
+		if self.config.NoDelay {
+			self.flush()
+		}
+		deadline := self.wd
+		self.lock.Unlock()
+		if n >= len(b) {
+			return n, nil
+		}
+		if !waitEvent(self.writeEvent, self.closing, self.dead, deadline) {
+			return n, errKCPTimeout
+		}
+	}
+}
+
+//关闭连接，未确认的数据在 KCP_LINGER 内继续重发，之后通知对端关闭
+func (self *KCPConn) Close() error {
+	self.closeOnce.Do(func() { close(self.closing) })
+	return nil
+}
+
+func (self *KCPConn) LocalAddr() net.Addr {
+	return self.local
+}
+func (self *KCPConn) RemoteAddr() net.Addr {
+	return self.remote
+}
+func (self *KCPConn) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.SetWriteDeadline(t)
+}
+func (self *KCPConn) SetReadDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.rd = t
+	self.lock.Unlock()
+	notify(self.readEvent)
+	return nil
+}
+func (self *KCPConn) SetWriteDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.wd = t
+	self.lock.Unlock()
+	notify(self.writeEvent)
+	return nil
+}
+
+//会话ID
+func (self *KCPConn) Conv() uint32 {
+	return self.conv
+}
+
+//连接彻底结束，释放底层资源
+func (self *KCPConn) die(err error) {
+	self.deadOnce.Do(func() {
+		if self.err == nil {
+			self.err = err
+		}
+		close(self.dead)
+		if self.teardown != nil {
+			go self.teardown()
+		}
+	})
+}
+
+//定时刷新，关闭后等待数据发完再发送关闭包
+func (self *KCPConn) update() {
+	ticker := time.NewTicker(self.config.Interval)
+	defer ticker.Stop()
+	var lingerUntil time.Time
+	closing := self.closing
+	for {
+		select {
+		case <-self.dead:
+			return
+		case <-closing:
+			closing = nil
+			lingerUntil = time.Now().Add(KCP_LINGER)
+		case <-ticker.C:
+		}
+		self.lock.Lock()
+		self.keepalive()
+		self.flush()
+		if !lingerUntil.IsZero() && (len(self.sndBuf)+len(self.sndQueue) == 0 || self.finRecv || time.Now().After(lingerUntil)) {
+			for i := 0; i < KCP_FIN_TIMES; i++ {
+				self.output(self.encode(nil, KCP_CMD_FIN, self.sndNxt, 0, nil))
+			}
+			self.die(net.ErrClosed)
+		}
+		self.lock.Unlock()
+	}
+}
+
+//对端超过 IdleTimeout 没有任何数据时关闭连接，监听器中的连接随之删除
+//空闲超过 1/3 超时时间时发出窗口询问，对端回复窗口大小，活着的连接不会因为没有业务数据被关闭，需持有锁
+func (self *KCPConn) keepalive() {
+	now := time.Now()
+	idle := now.Sub(self.lastRecv)
+	if idle > self.config.IdleTimeout {
+		self.die(ErrKCPDead)
+		return
+	}
+	if interval := self.config.IdleTimeout / 3; idle > interval && now.Sub(self.lastPing) > interval {
+		self.probeWask = true
+		self.lastPing = now
+	}
+}
+
+//接收窗口剩余
+func (self *KCPConn) wndUnused() uint16 {
+	if len(self.rcvQueue) < self.config.RcvWnd {
+		return uint16(self.config.RcvWnd - len(self.rcvQueue))
+	}
+	return 0
+}
+
+func (self *KCPConn) encode(buf []byte, cmd byte, sn, ts uint32, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, self.conv)
+	buf = append(buf, cmd)
+	buf = binary.BigEndian.AppendUint16(buf, self.wndUnused())
+	buf = binary.BigEndian.AppendUint32(buf, sn)
+	buf = binary.BigEndian.AppendUint32(buf, self.rcvNxt)
+	buf = binary.BigEndian.AppendUint32(buf, ts)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+	return append(buf, data...)
+}
+
+//把段加入待发数据报，超过 MTU 时先发出
+func (self *KCPConn) appendSegment(cmd byte, sn, ts uint32, data []byte) {
+	if len(self.flushBuf)+KCP_HEAD_LEN+len(data) > self.config.MTU {
+		self.output(self.flushBuf)
+		self.flushBuf = self.flushBuf[:0]
+	}
+	self.flushBuf = self.encode(self.flushBuf, cmd, sn, ts, data)
+}
+
+//发出确认、探测、新数据和需要重发的数据，需持有锁
+func (self *KCPConn) flush() {
+	if self.err != nil {
+		return
+	}
+	current := self.current()
+	for _, ack := range self.acklist {
+		self.appendSegment(KCP_CMD_ACK, ack.sn, ack.ts, nil)
+	}
+	self.acklist = self.acklist[:0]
+
+	//对端窗口为0时定时询问
+	if self.rmtWnd == 0 {
+		if self.probeTs == 0 {
+			self.probeTs = current + KCP_PROBE
+		} else if timediff(current, self.probeTs) >= 0 {
+			self.probeWask = true
+			self.probeTs = current + KCP_PROBE
+		}
+	} else {
+		self.probeTs = 0
+	}
+	if self.probeWask {
+		self.appendSegment(KCP_CMD_WASK, 0, 0, nil)
+		self.probeWask = false
+	}
+	if self.probeWins {
+		self.appendSegment(KCP_CMD_WINS, 0, 0, nil)
+		self.probeWins = false
+	}
+
+	cwnd := uint32(self.config.SndWnd)
+	if self.rmtWnd < cwnd {
+		cwnd = self.rmtWnd
+	}
+	if !self.config.NoCongestion && self.cwnd < cwnd {
+		cwnd = self.cwnd
+	}
+	moved := false
+	for len(self.sndQueue) > 0 && timediff(self.sndNxt, self.sndUna+cwnd) < 0 {
+		seg := self.sndQueue[0]
+		self.sndQueue[0] = nil
+		self.sndQueue = self.sndQueue[1:]
+		seg.sn = self.sndNxt
+		self.sndNxt++
+		self.sndBuf = append(self.sndBuf, seg)
+		moved = true
+	}
+	if moved {
+		notify(self.writeEvent)
+	}
+
+	rtomin := uint32(0)
+	if !self.config.NoDelay {
+		rtomin = self.rxRto >> 3
+	}
+	lost, change := false, false
+	for _, seg := range self.sndBuf {
+		send := false
+		if seg.xmit == 0 {
+			send = true
+			seg.rto = self.rxRto
+			seg.resendts = current + seg.rto + rtomin
+		} else if timediff(current, seg.resendts) >= 0 {
+			//超时重发
+			send = true
+			lost = true
+			if self.config.NoDelay {
+				seg.rto += seg.rto / 2
+			} else if seg.rto > self.rxRto {
+				seg.rto += seg.rto
+			} else {
+				seg.rto += self.rxRto
+			}
+			if seg.rto > KCP_RTO_MAX {
+				seg.rto = KCP_RTO_MAX
+			}
+			seg.resendts = current + seg.rto
+		} else if self.config.Resend > 0 && seg.fastack >= self.config.Resend {
+			//快速重传
+			send = true
+			change = true
+			seg.fastack = 0
+			seg.resendts = current + seg.rto
+		}
+		if send {
+			seg.xmit++
+			seg.ts = current
+			self.appendSegment(KCP_CMD_PUSH, seg.sn, seg.ts, seg.data)
+			if seg.xmit > self.config.DeadLink {
+				self.die(ErrKCPDead)
+			}
+		}
+	}
+	if len(self.flushBuf) > 0 {
+		self.output(self.flushBuf)
+		self.flushBuf = self.flushBuf[:0]
+	}
+
+	if !self.config.NoCongestion {
+		if change {
+			inflight := self.sndNxt - self.sndUna
+			self.ssthresh = inflight / 2
+			if self.ssthresh < 2 {
+				self.ssthresh = 2
+			}
+			self.cwnd = self.ssthresh + uint32(self.config.Resend)
+			self.incr = self.cwnd * uint32(self.mss)
+		}
+		if lost {
+			self.ssthresh = self.cwnd / 2
+			if self.ssthresh < 2 {
+				self.ssthresh = 2
+			}
+			self.cwnd = 1
+			self.incr = uint32(self.mss)
+		}
+	}
+}
+
+//更新RTT估计和重发超时
+func (self *KCPConn) updateRtt(rtt int32) {
+	if self.rxSrtt == 0 {
+		self.rxSrtt = rtt
+		self.rxRttval = rtt / 2
+	} else {
+		delta := rtt - self.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		self.rxRttval = (3*self.rxRttval + delta) / 4
+		self.rxSrtt = (7*self.rxSrtt + rtt) / 8
+		if self.rxSrtt < 1 {
+			self.rxSrtt = 1
+		}
+	}
+	interval := int32(self.config.Interval / time.Millisecond)
+	if 4*self.rxRttval > interval {
+		interval = 4 * self.rxRttval
+	}
+	rto := uint32(self.rxSrtt + interval)
+	minrto := uint32(KCP_RTO_MIN)
+	if self.config.NoDelay {
+		minrto = KCP_RTO_NDL
+	}
+	if rto < minrto {
+		rto = minrto
+	}
+	if rto > KCP_RTO_MAX {
+		rto = KCP_RTO_MAX
+	}
+	self.rxRto = rto
+}
+
+//对端已收到 una 之前的所有段
+func (self *KCPConn) parseUna(una uint32) {
+	i := 0
+	for i < len(self.sndBuf) && timediff(self.sndBuf[i].sn, una) < 0 {
+		i++
+	}
+	if i > 0 {
+		self.sndBuf = append(self.sndBuf[:0], self.sndBuf[i:]...)
+	}
+	if len(self.sndBuf) > 0 {
+		self.sndUna = self.sndBuf[0].sn
+	} else {
+		self.sndUna = self.sndNxt
+	}
+}
+
+//选择确认，删除单个段
+func (self *KCPConn) parseAck(sn uint32) {
+	for i, seg := range self.sndBuf {
+		if seg.sn == sn {
+			self.sndBuf = append(self.sndBuf[:i], self.sndBuf[i+1:]...)
+			break
+		}
+		if timediff(seg.sn, sn) > 0 {
+			break
+		}
+	}
+	if len(self.sndBuf) > 0 {
+		self.sndUna = self.sndBuf[0].sn
+	} else {
+		self.sndUna = self.sndNxt
+	}
+}
+
+//被跳过的段计数，用于快速重传
+func (self *KCPConn) parseFastack(maxack uint32) {
+	for _, seg := range self.sndBuf {
+		if timediff(seg.sn, maxack) >= 0 {
+			break
+		}
+		seg.fastack++
+	}
+}
+
+//把按序到达的段移入读取队列，需持有锁
+func (self *KCPConn) moveRcvBuf() {
+	for len(self.rcvQueue) < self.config.RcvWnd {
+		data, ok := self.rcvBuf[self.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(self.rcvBuf, self.rcvNxt)
+		self.rcvQueue = append(self.rcvQueue, data)
+		self.rcvNxt++
+	}
+}
+
+//处理收到的数据报
+func (self *KCPConn) input(data []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.err != nil {
+		return
+	}
+	self.lastRecv = time.Now()
+	current := self.current()
+	oldUna := self.sndUna
+	var maxack uint32
+	hasAck, readable := false, false
+	for len(data) >= KCP_HEAD_LEN {
+		conv := binary.BigEndian.Uint32(data)
+		cmd := data[4]
+		wnd := binary.BigEndian.Uint16(data[5:])
+		sn := binary.BigEndian.Uint32(data[7:])
+		una := binary.BigEndian.Uint32(data[11:])
+		ts := binary.BigEndian.Uint32(data[15:])
+		length := int(binary.BigEndian.Uint16(data[19:]))
+		data = data[KCP_HEAD_LEN:]
+		if conv != self.conv || len(data) < length {
+			return
+		}
+		payload := data[:length]
+		data = data[length:]
+		self.rmtWnd = uint32(wnd)
+		self.parseUna(una)
+		switch cmd {
+		case KCP_CMD_ACK:
+			if rtt := timediff(current, ts); rtt >= 0 {
+				self.updateRtt(rtt)
+			}
+			self.parseAck(sn)
+			if !hasAck || timediff(sn, maxack) > 0 {
+				maxack = sn
+			}
+			hasAck = true
+		case KCP_CMD_PUSH:
+			if timediff(sn, self.rcvNxt+uint32(self.config.RcvWnd)) < 0 {
+				self.acklist = append(self.acklist, kcpAck{sn: sn, ts: ts})
+				if timediff(sn, self.rcvNxt) >= 0 {
+					if _, ok := self.rcvBuf[sn]; !ok {
+						self.rcvBuf[sn] = append([]byte(nil), payload...)
+					}
+				}
+				before := len(self.rcvQueue)
+				self.moveRcvBuf()
+				readable = readable || len(self.rcvQueue) > before
+			}
+		case KCP_CMD_WASK:
+			self.probeWins = true
+		case KCP_CMD_WINS, KCP_CMD_SYN:
+		case KCP_CMD_FIN:
+			self.finRecv = true
+			self.finSn = sn
+			readable = true
+		default:
+			return
+		}
+	}
+	if hasAck {
+		self.parseFastack(maxack)
+	}
+	//拥塞窗口增长
+	if !self.config.NoCongestion && timediff(self.sndUna, oldUna) > 0 && self.cwnd < self.rmtWnd {
+		mss := uint32(self.mss)
+		if self.cwnd < self.ssthresh {
+			self.cwnd++
+			self.incr += mss
+		} else {
+			if self.incr < mss {
+				self.incr = mss
+			}
+			self.incr += (mss*mss)/self.incr + mss/16
+			if (self.cwnd+1)*mss <= self.incr {
+				self.cwnd++
+			}
+		}
+	}
+	if timediff(self.sndUna, oldUna) > 0 {
+		notify(self.writeEvent)
+	}
+	if readable {
+		notify(self.readEvent)
+	}
+	if self.config.NoDelay && len(self.acklist) > 0 {
+		self.flush()
+	}
+}
+
+//随机会话ID
+func newConv() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+//连接可靠UDP服务器，UDP无连接，返回时不保证服务器可达
+func DialKCP(addr string, config *KCPConfig) (*KCPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	conn := newKCPConn(newConv(), config.normalize(), udp.LocalAddr(), udp.RemoteAddr(), func(data []byte) error {
+		_, err := udp.Write(data)
+		return err
+	}, func() { udp.Close() })
+	conn.lock.Lock()
+	for i := 0; i < KCP_SYN_TIMES; i++ {
+		conn.output(conn.encode(nil, KCP_CMD_SYN, 0, 0, nil))
+	}
+	conn.lock.Unlock()
+	go func() {
+		buf := make([]byte, UDP_RECV_BUF)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				conn.lock.Lock()
+				conn.die(err)
+				conn.lock.Unlock()
+				return
+			}
+			conn.input(buf[:n])
+		}
+	}()
+	return conn, nil
+}
+
+//可靠UDP的拨号器，用于 TCPClient.SetDialer，network 参数被忽略
+type KCPDialer struct {
+	Config *KCPConfig
+}
+
+func (self *KCPDialer) Dial(network, addr string) (net.Conn, error) {
+	return DialKCP(addr, self.Config)
+}
+
+//可靠UDP监听器，实现 net.Listener，用 TCPServer.ServeListener 接入
+type KCPListener struct {
+	udp       *net.UDPConn
+	config    KCPConfig
+	conns     map[string]*KCPConn //对端地址+会话ID -> 连接
+	lock      *sync.Mutex
+	accept    chan *KCPConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func ListenKCP(addr string, config *KCPConfig) (*KCPListener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	self := &KCPListener{
+		udp:    udp,
+		config: config.normalize(),
+		conns:  make(map[string]*KCPConn),
+		lock:   new(sync.Mutex),
+		accept: make(chan *KCPConn, KCP_BACKLOG),
+		closed: make(chan struct{}),
+	}
+	go self.loop()
+	return self, nil
+}
+
+func kcpKey(addr *net.UDPAddr, conv uint32) string {
+	return addr.String() + "#" + string(binary.BigEndian.AppendUint32(nil, conv))
+}
+
+func (self *KCPListener) loop() {
+	buf := make([]byte, UDP_RECV_BUF)
+	for {
+		n, addr, err := self.udp.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-self.closed:
+				return
+			default:
+			}
+			logger.Debug("kcp读取异常:", err)
+			continue
+		}
+		if n < KCP_HEAD_LEN {
+			continue
+		}
+		conv := binary.BigEndian.Uint32(buf)
+		key := kcpKey(addr, conv)
+		self.lock.Lock()
+		conn := self.conns[key]
+		//只有拨号时的 SYN 或首个数据段能创建连接，避免已关闭连接的迟到包生成新连接
+		if conn == nil && (buf[4] == KCP_CMD_SYN || buf[4] == KCP_CMD_PUSH && binary.BigEndian.Uint32(buf[7:]) == 0) {
+			select {
+			case <-self.closed:
+			default:
+				remote := addr
+				conn = newKCPConn(conv, self.config, self.udp.LocalAddr(), remote, func(data []byte) error {
+					_, err := self.udp.WriteToUDP(data, remote)
+					return err
+				}, func() { self.remove(key) })
+				select {
+				case self.accept <- conn:
+					self.conns[key] = conn
+				default:
+					//积压已满
+					conn.lock.Lock()
+					conn.die(net.ErrClosed)
+					conn.lock.Unlock()
+					conn = nil
+				}
+			}
+		}
+		self.lock.Unlock()
+		if conn != nil {
+			conn.input(buf[:n])
+		}
+	}
+}
+
+func (self *KCPListener) remove(key string) {
+	self.lock.Lock()
+	delete(self.conns, key)
+	self.lock.Unlock()
+}
+
+func (self *KCPListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.accept:
+		return conn, nil
+	case <-self.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+//关闭监听，已建立的连接也会被关闭
+func (self *KCPListener) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+		self.lock.Lock()
+		conns := make([]*KCPConn, 0, len(self.conns))
+		for _, conn := range self.conns {
+			conns = append(conns, conn)
+		}
+		self.lock.Unlock()
+		for _, conn := range conns {
+			conn.lock.Lock()
+			conn.die(net.ErrClosed)
+			conn.lock.Unlock()
+		}
+		self.udp.Close()
+	})
+	return nil
+}
+
+func (self *KCPListener) Addr() net.Addr {
+	return self.udp.LocalAddr()
+}
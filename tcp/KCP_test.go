@@ -0,0 +1,153 @@
+package tcp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//回显服务器
+func kcpEchoListener(t *testing.T, config *KCPConfig) *KCPListener {
+	listener, err := ListenKCP("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+//在模拟丢包的回环上收发 size 字节，校验数据完整且有序
+func kcpRoundTrip(t *testing.T, config *KCPConfig, size int) {
+	listener := kcpEchoListener(t, config)
+	conn, err := DialKCP(listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go conn.Write(data)
+	got := make([]byte, size)
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted")
+	}
+}
+
+func TestKCPLoss(t *testing.T) {
+	config := DefaultKCPConfig()
+	config.LossRate = 0.2
+	kcpRoundTrip(t, config, 32*1024)
+}
+
+func TestKCPLossFast(t *testing.T) {
+	config := FastKCPConfig()
+	config.LossRate = 0.3
+	kcpRoundTrip(t, config, 64*1024)
+}
+
+//客户端只拨号不写数据也能被 Accept
+func TestKCPAcceptWithoutData(t *testing.T) {
+	listener, err := ListenKCP("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := DialKCP(listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		if c.(*KCPConn).Conv() != conn.Conv() {
+			t.Fatal("conv mismatch")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not accepted")
+	}
+}
+
+//对端不再发送任何数据时，超过 IdleTimeout 关闭连接并从监听器中删除
+func TestKCPIdleTimeout(t *testing.T) {
+	config := DefaultKCPConfig()
+	config.IdleTimeout = 300 * time.Millisecond
+	listener, err := ListenKCP("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	//只发 SYN 之后不再响应的对端
+	peer, err := net.DialUDP("udp", nil, listener.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	syn := (&KCPConn{conv: 1, config: *config}).encode(nil, KCP_CMD_SYN, 0, 0, nil)
+	peer.Write(syn)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err != ErrKCPDead {
+		t.Fatalf("want ErrKCPDead, got %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		listener.lock.Lock()
+		n := len(listener.conns)
+		listener.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dead conn not removed from listener")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//空闲但存活的连接靠保活探测维持，不会超时
+func TestKCPKeepalive(t *testing.T) {
+	config := DefaultKCPConfig()
+	config.IdleTimeout = 300 * time.Millisecond
+	listener := kcpEchoListener(t, config)
+	conn, err := DialKCP(listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(4 * config.IdleTimeout)
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatal(string(buf), err)
+	}
+}
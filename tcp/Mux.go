@@ -0,0 +1,454 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//多路复用控制消息类型，流ID放在 PacketHead.Targetid 中
+const (
+	MUX_OPEN   byte = 0xE0 //打开流
+	MUX_DATA   byte = 0xE1 //流数据
+	MUX_CLOSE  byte = 0xE2 //关闭流，本端不再收发数据，对端随后的写入返回 ErrStreamClosed
+	MUX_RESET  byte = 0xE3 //重置流，双方立即丢弃
+	MUX_WINDOW byte = 0xE4 //窗口更新，数据为4字节的窗口增量
+)
+
+const (
+	MUX_WINDOW_SIZE uint32 = 256 * 1024 //每个流的初始接收窗口
+	MUX_MAX_FRAME          = 0xFFFF     //单个数据帧的最大长度，受 Datalen 限制
+	MUX_BACKLOG            = 64         //等待 Accept 的流的最大数量
+)
+
+var (
+	ErrStreamClosed = errors.New("stream closed")
+	ErrStreamReset  = errors.New("stream reset")
+	ErrMuxClosed    = errors.New("mux closed")
+	errMuxTimeout   = &timeoutError{}
+)
+
+//超时错误，实现 net.Error
+type timeoutError struct{}
+
+func (self *timeoutError) Error() string   { return "i/o timeout" }
+func (self *timeoutError) Timeout() bool   { return true }
+func (self *timeoutError) Temporary() bool { return true }
+
+//流的地址
+type muxAddr uint64
+
+func (self muxAddr) Network() string { return "mux" }
+func (self muxAddr) String() string  { return "stream:" + strconv.FormatUint(uint64(self), 10) }
+
+//基于 ByteProto 的多路复用器，在一个连接上承载多个独立的双向流
+type Mux struct {
+	write    func(data []byte) (int, error)
+	streams  map[uint64]*Stream
+	lock     *sync.Mutex
+	nextId   uint64
+	accepts  chan *Stream
+	isClosed bool
+}
+
+//创建多路复用器，write 为底层连接的写方法，两端的 isClient 必须相反（客户端流ID为奇数，服务端为偶数）
+//收到的包需要调用 Input 交给多路复用器
+func NewMux(write func(data []byte) (int, error), isClient bool) *Mux {
+	mux := &Mux{
+		write:   write,
+		streams: make(map[uint64]*Stream),
+		lock:    new(sync.Mutex),
+		accepts: make(chan *Stream, MUX_BACKLOG),
+		nextId:  2,
+	}
+	if isClient {
+		mux.nextId = 1
+	}
+	return mux
+}
+
+//在 TCPClient 上创建多路复用器，客户端需使用 PROTO_BYTE 协议
+//多路复用的包在 OnData 之前被取走，其它包照常回调，连接断开时所有流被重置
+//通过 Events 监听断开，直接给 OnClose/OnError 赋值后需要自己调用 Close
+func NewClientMux(client *TCPClient) *Mux {
+	mux := NewMux(client.Write, true)
+	client.addFilter(func(data []byte) []byte {
+		if mux.Input(data) {
+			return nil
+		}
+		return data
+	})
+	client.Events.Close.AddOrder(-1, mux.resetStreams)
+	client.Events.Error.AddOrder(-1, func(err error) { mux.resetStreams() })
+	return mux
+}
+
+//在服务端连接上创建多路复用器，需要在服务器的 OnData 中调用 Input，在 OnClose/OnError 中调用 Close
+func NewServerMux(client *Client) *Mux {
+	return NewMux(client.Write, false)
+}
+
+//处理收到的包，不是多路复用的包返回false
+func (self *Mux) Input(packet []byte) bool {
+	if uint32(len(packet)) < HEAD_LEN {
+		return false
+	}
+	msgtype := packet[HEAD_MSGTYPE_POS]
+	if msgtype < MUX_OPEN || msgtype > MUX_WINDOW {
+		return false
+	}
+	id := binary.BigEndian.Uint64(packet[HEAD_TARGETID_POS:])
+	data := packet[HEAD_LEN:]
+	self.lock.Lock()
+	stream := self.streams[id]
+	if msgtype == MUX_OPEN && stream == nil && !self.isClosed {
+		stream = newStream(id, self)
+		select {
+		case self.accepts <- stream:
+			self.streams[id] = stream
+		default:
+			//等待接受的流过多，拒绝
+			self.lock.Unlock()
+			self.writeFrame(MUX_RESET, id, nil)
+			return true
+		}
+	}
+	self.lock.Unlock()
+	if stream == nil {
+		if msgtype != MUX_RESET {
+			self.writeFrame(MUX_RESET, id, nil)
+		}
+		return true
+	}
+	switch msgtype {
+	case MUX_DATA:
+		if !stream.recv(data) {
+			stream.Reset()
+		}
+	case MUX_CLOSE:
+		stream.remoteClose()
+	case MUX_RESET:
+		stream.remoteReset()
+	case MUX_WINDOW:
+		if len(data) >= 4 {
+			stream.addWindow(binary.BigEndian.Uint32(data))
+		}
+	}
+	return true
+}
+
+//打开一个新流
+func (self *Mux) OpenStream() (*Stream, error) {
+	self.lock.Lock()
+	if self.isClosed {
+		self.lock.Unlock()
+		return nil, ErrMuxClosed
+	}
+	id := self.nextId
+	self.nextId += 2
+	stream := newStream(id, self)
+	self.streams[id] = stream
+	self.lock.Unlock()
+	if _, err := self.writeFrame(MUX_OPEN, id, nil); err != nil {
+		self.remove(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+//等待对端打开的流
+func (self *Mux) Accept() (*Stream, error) {
+	stream, ok := <-self.accepts
+	if !ok {
+		return nil, ErrMuxClosed
+	}
+	return stream, nil
+}
+
+//当前流的数量
+func (self *Mux) NumStreams() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.streams)
+}
+
+//关闭多路复用器，重置所有流
+func (self *Mux) Close() {
+	self.lock.Lock()
+	if self.isClosed {
+		self.lock.Unlock()
+		return
+	}
+	self.isClosed = true
+	close(self.accepts)
+	self.lock.Unlock()
+	self.resetStreams()
+}
+
+//底层连接断开，本地重置所有流
+func (self *Mux) resetStreams() {
+	self.lock.Lock()
+	streams := self.streams
+	self.streams = make(map[uint64]*Stream)
+	self.lock.Unlock()
+	for _, stream := range streams {
+		stream.remoteReset()
+	}
+}
+
+func (self *Mux) remove(id uint64) {
+	self.lock.Lock()
+	delete(self.streams, id)
+	self.lock.Unlock()
+}
+
+//封包写出，使用缓冲池避免每帧分配
+func (self *Mux) writeFrame(msgtype byte, id uint64, data []byte) (int, error) {
+	bufp := GetBuf(int(HEAD_LEN) + len(data))
+	defer PutBuf(bufp)
+	frame, err := AppendFrame((*bufp)[:0], 1, msgtype, id, data)
+	if err != nil {
+		return 0, err
+	}
+	return self.write(frame)
+}
+
+//多路复用的逻辑流，实现 net.Conn
+type Stream struct {
+	id            uint64
+	mux           *Mux
+	lock          *sync.Mutex
+	cond          *sync.Cond
+	rbuf          []byte //已收到未读取的数据
+	sendWindow    uint32 //对端允许发送的字节数
+	recvConsumed  uint32 //上次窗口更新后读取的字节数
+	localClosed   bool
+	remoteClosed  bool
+	isReset       bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(id uint64, mux *Mux) *Stream {
+	stream := &Stream{
+		id:         id,
+		mux:        mux,
+		lock:       new(sync.Mutex),
+		sendWindow: MUX_WINDOW_SIZE,
+	}
+	stream.cond = sync.NewCond(stream.lock)
+	return stream
+}
+
+//流ID
+func (self *Stream) Id() uint64 {
+	return self.id
+}
+
+func (self *Stream) Read(b []byte) (n int, err error) {
+	self.lock.Lock()
+	for len(self.rbuf) == 0 {
+		switch {
+		case self.isReset:
+			err = ErrStreamReset
+		case self.localClosed:
+			err = ErrStreamClosed
+		case self.remoteClosed:
+			err = io.EOF
+		case !self.readDeadline.IsZero() && !time.Now().Before(self.readDeadline):
+			err = errMuxTimeout
+		}
+		if err != nil {
+			self.lock.Unlock()
+			return
+		}
+		self.cond.Wait()
+	}
+	n = copy(b, self.rbuf)
+	self.rbuf = self.rbuf[n:]
+	if len(self.rbuf) == 0 {
+		self.rbuf = nil
+	}
+	self.recvConsumed += uint32(n)
+	var inc uint32
+	if self.recvConsumed >= MUX_WINDOW_SIZE/2 {
+		inc = self.recvConsumed
+		self.recvConsumed = 0
+	}
+	self.lock.Unlock()
+	if inc > 0 {
+		var data [4]byte
+		binary.BigEndian.PutUint32(data[:], inc)
+		self.mux.writeFrame(MUX_WINDOW, self.id, data[:])
+	}
+	return
+}
+
+func (self *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		self.lock.Lock()
+		//每次发送前都检查状态和超时，窗口充足时也不能越过写超时
+		for {
+			switch {
+			case self.isReset:
+				err = ErrStreamReset
+			case self.localClosed, self.remoteClosed:
+				//对端关闭后不再读取，继续写只会耗尽窗口
+				err = ErrStreamClosed
+			case !self.writeDeadline.IsZero() && !time.Now().Before(self.writeDeadline):
+				err = errMuxTimeout
+			}
+			if err != nil {
+				self.lock.Unlock()
+				return
+			}
+			if self.sendWindow > 0 {
+				break
+			}
+			self.cond.Wait()
+		}
+		chunk := len(b)
+		if chunk > MUX_MAX_FRAME {
+			chunk = MUX_MAX_FRAME
+		}
+		if uint32(chunk) > self.sendWindow {
+			chunk = int(self.sendWindow)
+		}
+		self.sendWindow -= uint32(chunk)
+		self.lock.Unlock()
+		if _, err = self.mux.writeFrame(MUX_DATA, self.id, b[:chunk]); err != nil {
+			return
+		}
+		n += chunk
+		b = b[chunk:]
+	}
+	return
+}
+
+//关闭流，通知对端不再发送数据，本端也不再读取
+func (self *Stream) Close() error {
+	self.lock.Lock()
+	if self.localClosed || self.isReset {
+		self.lock.Unlock()
+		return nil
+	}
+	self.localClosed = true
+	self.rbuf = nil
+	remoteClosed := self.remoteClosed
+	self.cond.Broadcast()
+	self.lock.Unlock()
+	if remoteClosed {
+		self.mux.remove(self.id)
+	}
+	_, err := self.mux.writeFrame(MUX_CLOSE, self.id, nil)
+	return err
+}
+
+//重置流，未发送和未读取的数据都被丢弃
+func (self *Stream) Reset() error {
+	self.lock.Lock()
+	if self.isReset {
+		self.lock.Unlock()
+		return nil
+	}
+	self.isReset = true
+	self.rbuf = nil
+	self.cond.Broadcast()
+	self.lock.Unlock()
+	self.mux.remove(self.id)
+	_, err := self.mux.writeFrame(MUX_RESET, self.id, nil)
+	return err
+}
+
+func (self *Stream) LocalAddr() net.Addr {
+	return muxAddr(self.id)
+}
+func (self *Stream) RemoteAddr() net.Addr {
+	return muxAddr(self.id)
+}
+func (self *Stream) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.SetWriteDeadline(t)
+}
+func (self *Stream) SetReadDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.readDeadline = t
+	self.lock.Unlock()
+	self.wakeAt(t)
+	return nil
+}
+func (self *Stream) SetWriteDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.writeDeadline = t
+	self.lock.Unlock()
+	self.wakeAt(t)
+	return nil
+}
+
+//到达超时时间时唤醒等待的读写
+func (self *Stream) wakeAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		self.lock.Lock()
+		self.cond.Broadcast()
+		self.lock.Unlock()
+	})
+}
+
+//收到数据，超出接收窗口返回false
+//本端关闭后收到的数据直接丢弃，并归还对端的发送窗口，对端在收到关闭之前的写入不会因此阻塞
+func (self *Stream) recv(data []byte) bool {
+	self.lock.Lock()
+	if self.isReset {
+		self.lock.Unlock()
+		return true
+	}
+	if self.localClosed {
+		self.lock.Unlock()
+		if len(data) > 0 {
+			var inc [4]byte
+			binary.BigEndian.PutUint32(inc[:], uint32(len(data)))
+			self.mux.writeFrame(MUX_WINDOW, self.id, inc[:])
+		}
+		return true
+	}
+	defer self.lock.Unlock()
+	if uint32(len(self.rbuf)+len(data)) > MUX_WINDOW_SIZE {
+		return false
+	}
+	self.rbuf = append(self.rbuf, data...)
+	self.cond.Broadcast()
+	return true
+}
+
+func (self *Stream) remoteClose() {
+	self.lock.Lock()
+	self.remoteClosed = true
+	localClosed := self.localClosed
+	self.cond.Broadcast()
+	self.lock.Unlock()
+	if localClosed {
+		self.mux.remove(self.id)
+	}
+}
+
+func (self *Stream) remoteReset() {
+	self.lock.Lock()
+	self.isReset = true
+	self.cond.Broadcast()
+	self.lock.Unlock()
+	self.mux.remove(self.id)
+}
+
+func (self *Stream) addWindow(inc uint32) {
+	self.lock.Lock()
+	self.sendWindow += inc
+	self.cond.Broadcast()
+	self.lock.Unlock()
+}
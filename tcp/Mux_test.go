@@ -0,0 +1,113 @@
+package tcp
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+//内存中相连的一对多路复用器，帧按顺序异步送达对端
+func muxPair(t *testing.T) (client, server *Mux) {
+	toServer := make(chan []byte, 1024)
+	toClient := make(chan []byte, 1024)
+	pipe := func(ch chan []byte) func(data []byte) (int, error) {
+		return func(data []byte) (int, error) {
+			ch <- append([]byte(nil), data...)
+			return len(data), nil
+		}
+	}
+	client = NewMux(pipe(toServer), true)
+	server = NewMux(pipe(toClient), false)
+	done := make(chan struct{})
+	feed := func(ch chan []byte, mux *Mux) {
+		for {
+			select {
+			case frame := <-ch:
+				mux.Input(frame)
+			case <-done:
+				return
+			}
+		}
+	}
+	go feed(toServer, server)
+	go feed(toClient, client)
+	t.Cleanup(func() {
+		close(done)
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func TestMuxStream(t *testing.T) {
+	client, server := muxPair(t)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//超过接收窗口的数据靠窗口更新继续发送
+	data := make([]byte, 3*MUX_WINDOW_SIZE)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		stream.Write(data)
+		stream.Close()
+	}()
+	got, err := io.ReadAll(peer)
+	if err != nil || len(got) != len(data) {
+		t.Fatal(len(got), err)
+	}
+	peer.Close()
+	waitStreams(t, client, 0)
+	waitStreams(t, server, 0)
+}
+
+//一端关闭后另一端继续写，写入返回 ErrStreamClosed 而不是阻塞在窗口上，双方关闭后流被移除
+func TestMuxWriteAfterPeerClose(t *testing.T) {
+	client, server := muxPair(t)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Close()
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, MUX_MAX_FRAME)
+		for {
+			if _, err := stream.Write(buf); err != nil {
+				result <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-result:
+		if err != ErrStreamClosed {
+			t.Fatalf("want ErrStreamClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer blocked after peer close")
+	}
+	stream.Close()
+	waitStreams(t, client, 0)
+	waitStreams(t, server, 0)
+}
+
+func waitStreams(t *testing.T, mux *Mux, n int) {
+	deadline := time.Now().Add(time.Second)
+	for mux.NumStreams() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams, want %d", mux.NumStreams(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
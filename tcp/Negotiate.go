@@ -0,0 +1,190 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+//握手消息类型，握手包固定使用版本1的格式
+const (
+	MSG_HELLO    byte = 0xF0 //握手请求 数据: 版本数(1字节)|版本列表|特性(4字节)
+	MSG_HELLO_OK byte = 0xF1 //握手应答 数据: 版本(1字节)|特性(4字节)
+)
+
+//协议版本，PacketHead.Version
+const (
+	PROTO_VERSION_1   byte = 1 //原始格式，不支持任何特性
+	PROTO_VERSION_2   byte = 2 //按协商的特性编解码
+	PROTO_MAX_VERSION      = PROTO_VERSION_2
+)
+
+//可协商的特性，只在版本2及以上生效
+const (
+	FEATURE_COMPRESS uint32 = 1 << iota //数据体 deflate 压缩
+	FEATURE_CHECKSUM                    //数据体后附加4字节 crc32 校验
+	FEATURE_LARGE                       //大包，Datalen 为 0xFFFF 时包头后4字节为实际长度
+)
+
+const (
+	LARGE_FLAG    uint16 = 0xFFFF
+	LARGE_MAX_BUF uint32 = 16 * 1024 * 1024 //大包的最大长度
+)
+
+var (
+	ErrChecksum = errors.New("packet checksum error")
+	ErrHello    = errors.New("bad hello packet")
+)
+
+//连接协商的结果，决定包的编解码方式
+type Codec struct {
+	Version  byte
+	Features uint32
+}
+
+//未协商的连接使用版本1
+var defaultCodec = &Codec{Version: PROTO_VERSION_1}
+
+func (self *Codec) Has(feature uint32) bool {
+	return self.Version >= PROTO_VERSION_2 && self.Features&feature != 0
+}
+
+//按协商结果封包
+func (self *Codec) Encode(msgtype byte, targetid uint64, data []byte) ([]byte, error) {
+	if self.Version < PROTO_VERSION_2 {
+		return AppendFrame(make([]byte, 0, int(HEAD_LEN)+len(data)), self.Version, msgtype, targetid, data)
+	}
+	payload := data
+	if self.Has(FEATURE_COMPRESS) {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		w.Write(data)
+		w.Close()
+		payload = buf.Bytes()
+	}
+	if self.Has(FEATURE_CHECKSUM) {
+		payload = binary.BigEndian.AppendUint32(payload[:len(payload):len(payload)], crc32.ChecksumIEEE(payload))
+	}
+	if len(payload) < int(LARGE_FLAG) {
+		return AppendFrame(make([]byte, 0, int(HEAD_LEN)+len(payload)), self.Version, msgtype, targetid, payload)
+	}
+	if !self.Has(FEATURE_LARGE) || uint32(len(payload)) > LARGE_MAX_BUF {
+		return nil, TO_LAGER
+	}
+	//大包：Datalen 置为 0xFFFF，包头后跟4字节实际长度
+	packet := make([]byte, HEAD_LEN+4, int(HEAD_LEN)+4+len(payload))
+	packet[HEAD_VERSION_POS] = self.Version
+	packet[HEAD_MSGTYPE_POS] = msgtype
+	binary.BigEndian.PutUint16(packet[HEAD_PACKETLEN_POS:], LARGE_FLAG)
+	binary.BigEndian.PutUint64(packet[HEAD_TARGETID_POS:], targetid)
+	binary.BigEndian.PutUint32(packet[HEAD_LEN:], uint32(len(payload)))
+	return append(packet, payload...), nil
+}
+
+//计算包头描述的完整包长度，数据不足以判断时返回false
+func (self *Codec) frameLen(data []byte) (uint32, bool) {
+	if uint32(len(data)) < HEAD_LEN {
+		return 0, false
+	}
+	packlen := binary.BigEndian.Uint16(data[HEAD_PACKETLEN_POS:])
+	if packlen == LARGE_FLAG && data[HEAD_VERSION_POS] >= PROTO_VERSION_2 && self.Has(FEATURE_LARGE) {
+		if uint32(len(data)) < HEAD_LEN+4 {
+			return 0, false
+		}
+		return HEAD_LEN + 4 + binary.BigEndian.Uint32(data[HEAD_LEN:]), true
+	}
+	return HEAD_LEN + uint32(packlen), true
+}
+
+//按包的版本解码，返回版本1格式的包（12字节包头+原始数据）
+//大包解码后 Datalen 为 0xFFFF，数据长度以 len(packet)-HEAD_LEN 为准
+func (self *Codec) Decode(packet []byte) ([]byte, error) {
+	if packet[HEAD_VERSION_POS] < PROTO_VERSION_2 || self.Version < PROTO_VERSION_2 {
+		return packet, nil
+	}
+	head := packet[:HEAD_LEN]
+	payload := packet[HEAD_LEN:]
+	if binary.BigEndian.Uint16(head[HEAD_PACKETLEN_POS:]) == LARGE_FLAG && self.Has(FEATURE_LARGE) {
+		payload = payload[4:]
+	}
+	if self.Has(FEATURE_CHECKSUM) {
+		if len(payload) < 4 {
+			return nil, ErrChecksum
+		}
+		sum := binary.BigEndian.Uint32(payload[len(payload)-4:])
+		payload = payload[:len(payload)-4]
+		if crc32.ChecksumIEEE(payload) != sum {
+			return nil, ErrChecksum
+		}
+	}
+	if self.Has(FEATURE_COMPRESS) {
+		//多读1字节用于判断解压后是否超长，超长的包不截断直接报错
+		data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(payload)), int64(LARGE_MAX_BUF)+1))
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(data)) > LARGE_MAX_BUF {
+			return nil, TO_LAGER
+		}
+		payload = data
+	}
+	datalen := LARGE_FLAG
+	if len(payload) < int(LARGE_FLAG) {
+		datalen = uint16(len(payload))
+	}
+	//数据体没有变化时原地改写包头，避免拷贝
+	if len(payload) > 0 && &payload[0] == &packet[HEAD_LEN] {
+		binary.BigEndian.PutUint16(head[HEAD_PACKETLEN_POS:], datalen)
+		return packet[:int(HEAD_LEN)+len(payload)], nil
+	}
+	out := make([]byte, int(HEAD_LEN)+len(payload))
+	copy(out, head)
+	binary.BigEndian.PutUint16(out[HEAD_PACKETLEN_POS:], datalen)
+	copy(out[HEAD_LEN:], payload)
+	return out, nil
+}
+
+//生成握手请求包
+func helloPacket(versions []byte, features uint32) []byte {
+	data := make([]byte, 0, 1+len(versions)+4)
+	data = append(data, byte(len(versions)))
+	data = append(data, versions...)
+	data = binary.BigEndian.AppendUint32(data, features)
+	return WarpData(MSG_HELLO, data)
+}
+
+//服务端处理握手请求，选出双方都支持的最高版本和共同的特性
+func negotiate(packet []byte, versions []byte, features uint32) (*Codec, error) {
+	data := packet[HEAD_LEN:]
+	if len(data) < 1 || len(data) < 1+int(data[0])+4 {
+		return nil, ErrHello
+	}
+	codec := &Codec{Version: PROTO_VERSION_1}
+	for _, v := range data[1 : 1+int(data[0])] {
+		if v > codec.Version && v <= PROTO_MAX_VERSION && bytes.IndexByte(versions, v) >= 0 {
+			codec.Version = v
+		}
+	}
+	if codec.Version >= PROTO_VERSION_2 {
+		codec.Features = features & binary.BigEndian.Uint32(data[1+int(data[0]):])
+	}
+	return codec, nil
+}
+
+//生成握手应答包
+func helloOkPacket(codec *Codec) []byte {
+	data := binary.BigEndian.AppendUint32([]byte{codec.Version}, codec.Features)
+	return WarpData(MSG_HELLO_OK, data)
+}
+
+//客户端解析握手应答
+func parseHelloOk(packet []byte) (*Codec, error) {
+	data := packet[HEAD_LEN:]
+	if len(data) < 5 {
+		return nil, ErrHello
+	}
+	return &Codec{Version: data[0], Features: binary.BigEndian.Uint32(data[1:])}, nil
+}
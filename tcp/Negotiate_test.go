@@ -0,0 +1,109 @@
+package tcp
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+//各种特性组合下编码后再解码得到版本1格式的原包
+func TestCodecRoundTrip(t *testing.T) {
+	small := []byte("hello")
+	large := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(large)
+	for features := uint32(0); features <= FEATURE_COMPRESS|FEATURE_CHECKSUM|FEATURE_LARGE; features++ {
+		codec := &Codec{Version: PROTO_VERSION_2, Features: features}
+		for _, data := range [][]byte{nil, small, large} {
+			packet, err := codec.Encode(7, 42, data)
+			if len(data) == len(large) && !codec.Has(FEATURE_LARGE) {
+				if err != TO_LAGER {
+					t.Fatalf("features %b: want TO_LAGER, got %v", features, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("features %b: %v", features, err)
+			}
+			if size, ok := codec.frameLen(packet); !ok || size != uint32(len(packet)) {
+				t.Fatalf("features %b: frameLen %d, packet %d", features, size, len(packet))
+			}
+			decoded, err := codec.Decode(packet)
+			if err != nil {
+				t.Fatalf("features %b: %v", features, err)
+			}
+			head := NewPacketHead(decoded)
+			if head.Msgtype != 7 || head.Targetid != 42 || !bytes.Equal(decoded[HEAD_LEN:], data) {
+				t.Fatalf("features %b: %d bytes decoded to %+v", features, len(data), head)
+			}
+		}
+	}
+	//版本1不做任何处理
+	packet, _ := defaultCodec.Encode(7, 42, small)
+	if decoded, err := defaultCodec.Decode(packet); err != nil || !bytes.Equal(decoded, packet) {
+		t.Fatal(decoded, err)
+	}
+}
+
+func TestCodecChecksum(t *testing.T) {
+	codec := &Codec{Version: PROTO_VERSION_2, Features: FEATURE_CHECKSUM}
+	packet, _ := codec.Encode(7, 42, []byte("hello"))
+	packet[HEAD_LEN] ^= 1
+	if _, err := codec.Decode(packet); err != ErrChecksum {
+		t.Fatalf("want ErrChecksum, got %v", err)
+	}
+}
+
+//解压后超过 LARGE_MAX_BUF 的包被拒绝
+func TestCodecDecompressTooLarge(t *testing.T) {
+	codec := &Codec{Version: PROTO_VERSION_2, Features: FEATURE_COMPRESS | FEATURE_LARGE}
+	packet, err := codec.Encode(7, 42, make([]byte, LARGE_MAX_BUF+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := codec.Decode(packet); err != TO_LAGER {
+		t.Fatalf("want TO_LAGER, got %v", err)
+	}
+	packet, _ = codec.Encode(7, 42, make([]byte, LARGE_MAX_BUF))
+	if decoded, err := codec.Decode(packet); err != nil || uint32(len(decoded)) != HEAD_LEN+LARGE_MAX_BUF {
+		t.Fatal(len(decoded), err)
+	}
+}
+
+//握手取双方共同支持的最高版本和特性
+func TestHello(t *testing.T) {
+	all := FEATURE_COMPRESS | FEATURE_CHECKSUM | FEATURE_LARGE
+	cases := []struct {
+		clientVersions, serverVersions []byte
+		clientFeatures, serverFeatures uint32
+		want                           Codec
+	}{
+		{[]byte{1, 2}, []byte{1, 2}, all, all, Codec{PROTO_VERSION_2, all}},
+		{[]byte{1, 2}, []byte{1, 2}, FEATURE_COMPRESS | FEATURE_LARGE, FEATURE_COMPRESS | FEATURE_CHECKSUM, Codec{PROTO_VERSION_2, FEATURE_COMPRESS}},
+		{[]byte{1, 2}, []byte{1, 2}, 0, all, Codec{PROTO_VERSION_2, 0}},
+		//版本1不协商特性
+		{[]byte{1, 2}, []byte{1}, all, all, Codec{PROTO_VERSION_1, 0}},
+		{[]byte{1}, []byte{1, 2}, all, all, Codec{PROTO_VERSION_1, 0}},
+		//不认识的版本被忽略
+		{[]byte{2, 9}, []byte{1, 2, 9}, all, all, Codec{PROTO_VERSION_2, all}},
+	}
+	for i, c := range cases {
+		hello := helloPacket(c.clientVersions, c.clientFeatures)
+		if hello[HEAD_MSGTYPE_POS] != MSG_HELLO || hello[HEAD_VERSION_POS] != PROTO_VERSION_1 {
+			t.Fatalf("case %d: bad hello head", i)
+		}
+		codec, err := negotiate(hello, c.serverVersions, c.serverFeatures)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		got, err := parseHelloOk(helloOkPacket(codec))
+		if err != nil || *got != c.want || *codec != c.want {
+			t.Fatalf("case %d: got %+v, want %+v", i, got, c.want)
+		}
+	}
+	if _, err := negotiate(WarpData(MSG_HELLO, []byte{3, 1}), []byte{1, 2}, all); err != ErrHello {
+		t.Fatalf("want ErrHello, got %v", err)
+	}
+	if _, err := parseHelloOk(WarpData(MSG_HELLO_OK, []byte{2})); err != ErrHello {
+		t.Fatalf("want ErrHello, got %v", err)
+	}
+}
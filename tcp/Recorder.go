@@ -0,0 +1,374 @@
+package tcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//记录文件格式：
+//文件头 TCPREC|版本(1字节)|协议类型(1字节)|记录端(1字节)
+//记录   方向(1字节)|时间纳秒(8字节)|连接ID(8字节)|数据长度(4字节)|数据
+//版本1的文件头没有记录端，按服务端读取
+const (
+	REC_MAGIC   = "TCPREC"
+	REC_VERSION = 2
+	REC_HEAD    = 21 //记录头长度
+)
+
+//记录端，回放时决定哪个方向的数据发给服务器
+const (
+	REC_SIDE_SERVER byte = 1 //TCPServer 的记录，回放收到的包
+	REC_SIDE_CLIENT byte = 2 //TCPClient 的记录，回放写出的原始数据
+)
+
+//记录方向
+const (
+	REC_IN  byte = 1 //收到的包，已拆包（JSON协议不含 \r\n，字节协议含包头）
+	REC_OUT byte = 2 //写出的原始数据
+)
+
+const REC_FLUSH_INTERVAL = time.Second
+
+//回放握手包后等待服务器应答的时间
+const REC_HELLO_TIMEOUT = 5 * time.Second
+
+//单条记录的最大长度，与协商大包后的最大包长一致
+const REC_MAX_DATA = LARGE_MAX_BUF + HEAD_LEN + 4
+
+var ErrRecordFormat = errors.New("bad record file")
+
+//会话记录器，把连接收发的数据带上时间戳写入文件，可并发调用
+type Recorder struct {
+	file   *os.File
+	w      *bufio.Writer
+	lock   *sync.Mutex
+	head   [REC_HEAD]byte
+	closed chan struct{}
+}
+
+//创建记录文件，protoType 为被记录连接使用的协议，回放时用于重新封包
+//side 为 REC_SIDE_SERVER 或 REC_SIDE_CLIENT，需与调用 SetRecorder 的一端一致
+func NewRecorder(path string, protoType int, side byte) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recorder{
+		file:   file,
+		w:      bufio.NewWriter(file),
+		lock:   new(sync.Mutex),
+		closed: make(chan struct{}),
+	}
+	rec.w.WriteString(REC_MAGIC)
+	rec.w.WriteByte(REC_VERSION)
+	rec.w.WriteByte(byte(protoType))
+	rec.w.WriteByte(side)
+	go rec.flushLoop()
+	return rec, nil
+}
+
+//定时落盘，没有新记录时缓存的数据也不会一直留在内存中
+func (self *Recorder) flushLoop() {
+	ticker := time.NewTicker(REC_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.lock.Lock()
+			if self.w.Buffered() > 0 {
+				self.w.Flush()
+			}
+			self.lock.Unlock()
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+//写入一条记录，最多缓存 REC_FLUSH_INTERVAL 时间后落盘，超过 REC_MAX_DATA 的数据返回 TO_LAGER
+func (self *Recorder) Record(connid uint64, dir byte, data []byte) error {
+	if uint32(len(data)) > REC_MAX_DATA {
+		return TO_LAGER
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.head[0] = dir
+	binary.BigEndian.PutUint64(self.head[1:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(self.head[9:], connid)
+	binary.BigEndian.PutUint32(self.head[17:], uint32(len(data)))
+	self.w.Write(self.head[:])
+	_, err := self.w.Write(data)
+	return err
+}
+
+func (self *Recorder) Flush() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.w.Flush()
+}
+
+func (self *Recorder) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	select {
+	case <-self.closed:
+		return nil
+	default:
+		close(self.closed)
+	}
+	self.w.Flush()
+	return self.file.Close()
+}
+
+//一条记录
+type Record struct {
+	Dir    byte
+	Time   time.Time
+	Connid uint64
+	Data   []byte
+}
+
+//记录文件读取器
+type RecordReader struct {
+	file      *os.File
+	r         *bufio.Reader
+	ProtoType int
+	Side      byte
+}
+
+func OpenRecord(path string) (*RecordReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := &RecordReader{file: file, r: bufio.NewReader(file)}
+	head := make([]byte, len(REC_MAGIC)+2)
+	if _, err := io.ReadFull(reader.r, head); err != nil || string(head[:len(REC_MAGIC)]) != REC_MAGIC {
+		file.Close()
+		return nil, ErrRecordFormat
+	}
+	reader.ProtoType = int(head[len(REC_MAGIC)+1])
+	reader.Side = REC_SIDE_SERVER
+	switch head[len(REC_MAGIC)] {
+	case 1:
+	case REC_VERSION:
+		if reader.Side, err = reader.r.ReadByte(); err != nil {
+			file.Close()
+			return nil, ErrRecordFormat
+		}
+	default:
+		file.Close()
+		return nil, ErrRecordFormat
+	}
+	return reader, nil
+}
+
+//读取下一条记录，读完返回 io.EOF，进程异常退出造成的半截记录也当作结束
+//记录长度超过 REC_MAX_DATA 说明文件已损坏，返回 ErrRecordFormat
+func (self *RecordReader) Next() (*Record, error) {
+	var head [REC_HEAD]byte
+	if _, err := io.ReadFull(self.r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[17:])
+	if size > REC_MAX_DATA {
+		return nil, ErrRecordFormat
+	}
+	rec := &Record{
+		Dir:    head[0],
+		Time:   time.Unix(0, int64(binary.BigEndian.Uint64(head[1:]))),
+		Connid: binary.BigEndian.Uint64(head[9:]),
+		Data:   make([]byte, size),
+	}
+	if _, err := io.ReadFull(self.r, rec.Data); err != nil {
+		return nil, io.EOF
+	}
+	return rec, nil
+}
+
+func (self *RecordReader) Close() error {
+	return self.file.Close()
+}
+
+//按记录的时间间隔回放，speed 为加速倍数，小于等于0时不等待
+//每条记录回调一次 handler，handler 返回错误时停止回放
+func Replay(path string, speed float64, handler func(rec *Record) error) error {
+	reader, err := OpenRecord(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	var first time.Time
+	start := time.Now()
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if speed > 0 {
+			offset := time.Duration(float64(rec.Time.Sub(first)) / speed)
+			if wait := offset - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if err := handler(rec); err != nil {
+			return err
+		}
+	}
+}
+
+//按原连接把客户端发出的数据回放给 dial 建立的连接，服务器的回写数据被丢弃
+//服务端的记录回放收到的包：先发握手包，再按服务器应答的编解码方式重新封包
+//客户端的记录原样回放写出的数据，要求服务器的协商结果与记录时相同
+func ReplayConns(path string, speed float64, dial func() (net.Conn, error)) error {
+	reader, err := OpenRecord(path)
+	if err != nil {
+		return err
+	}
+	protoType, side := reader.ProtoType, reader.Side
+	reader.Close()
+	dir := REC_IN
+	if side == REC_SIDE_CLIENT {
+		dir = REC_OUT
+	}
+	conns := make(map[uint64]*replayConn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	return Replay(path, speed, func(rec *Record) error {
+		if rec.Dir != dir {
+			return nil
+		}
+		conn, ok := conns[rec.Connid]
+		if !ok {
+			c, err := dial()
+			if err != nil {
+				return err
+			}
+			conn = newReplayConn(c, protoType == PROTO_BYTE && side == REC_SIDE_SERVER)
+			conns[rec.Connid] = conn
+		}
+		data := rec.Data
+		switch {
+		case side == REC_SIDE_CLIENT:
+		case protoType == PROTO_JSON:
+			data = append(data, 13, 10)
+		default:
+			return conn.writePacket(data)
+		}
+		_, err := conn.Write(data)
+		return err
+	})
+}
+
+//回放用的连接，记录着服务器对回放的握手包的应答
+type replayConn struct {
+	net.Conn
+	codec *Codec
+	hello chan *Codec
+	sent  bool //已发送握手包
+}
+
+//hello 为 true 时从服务器的回写数据中找出握手应答，否则直接丢弃回写数据
+func newReplayConn(conn net.Conn, hello bool) *replayConn {
+	rc := &replayConn{Conn: conn, codec: defaultCodec, hello: make(chan *Codec, 1)}
+	if hello {
+		go rc.readHello()
+	} else {
+		go io.Copy(io.Discard, conn)
+	}
+	return rc
+}
+
+//握手完成前服务器按版本1封包，找到握手应答后丢弃其余数据
+func (self *replayConn) readHello() {
+	r := bufio.NewReader(self.Conn)
+	defer io.Copy(io.Discard, r)
+	defer close(self.hello)
+	head := make([]byte, HEAD_LEN)
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			return
+		}
+		packet := make([]byte, HEAD_LEN+uint32(binary.BigEndian.Uint16(head[HEAD_PACKETLEN_POS:])))
+		copy(packet, head)
+		if _, err := io.ReadFull(r, packet[HEAD_LEN:]); err != nil {
+			return
+		}
+		if packet[HEAD_MSGTYPE_POS] == MSG_HELLO_OK {
+			if codec, err := parseHelloOk(packet); err == nil {
+				self.hello <- codec
+			}
+			return
+		}
+	}
+}
+
+//回放一个已解码的包，版本1的包原样写出，版本2的包按握手结果重新封包
+func (self *replayConn) writePacket(packet []byte) error {
+	if uint32(len(packet)) < HEAD_LEN {
+		return ErrRecordFormat
+	}
+	if packet[HEAD_MSGTYPE_POS] == MSG_HELLO {
+		//只回放第一次握手
+		if self.sent {
+			return nil
+		}
+		self.sent = true
+		if _, err := self.Write(packet); err != nil {
+			return err
+		}
+		select {
+		case codec, ok := <-self.hello:
+			if !ok {
+				return ErrHello
+			}
+			self.codec = codec
+			return nil
+		case <-time.After(REC_HELLO_TIMEOUT):
+			return ErrHello
+		}
+	}
+	if packet[HEAD_VERSION_POS] >= PROTO_VERSION_2 && self.codec.Version >= PROTO_VERSION_2 {
+		var err error
+		packet, err = self.codec.Encode(packet[HEAD_MSGTYPE_POS], binary.BigEndian.Uint64(packet[HEAD_TARGETID_POS:]), packet[HEAD_LEN:])
+		if err != nil {
+			return err
+		}
+	}
+	_, err := self.Write(packet)
+	return err
+}
+
+//回放到网络上的服务器
+func ReplayToAddr(path, addr string, speed float64) error {
+	return ReplayConns(path, speed, func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+}
+
+//在进程内回放给服务器，不需要监听端口
+func ReplayToServer(path string, speed float64, ser *TCPServer) error {
+	return ReplayConns(path, speed, func() (net.Conn, error) {
+		server, client := net.Pipe()
+		go ser.ServeConn(server)
+		return client, nil
+	})
+}
@@ -0,0 +1,122 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const recFeatures = FEATURE_COMPRESS | FEATURE_CHECKSUM | FEATURE_LARGE
+
+//开启协商的服务器，收到的包按顺序送入返回的通道
+func newRecServer() (*TCPServer, chan []byte) {
+	ser := NewTCPServer()
+	ser.SetProto(PROTO_BYTE)
+	ser.SetFeatures([]byte{PROTO_VERSION_1, PROTO_VERSION_2}, recFeatures)
+	received := make(chan []byte, 16)
+	ser.Events.Data.Add(func(conn *Client, data []byte) {
+		received <- append([]byte(nil), data...)
+	})
+	return ser, received
+}
+
+func recvPackets(t *testing.T, received chan []byte, n int) [][]byte {
+	packets := make([][]byte, 0, n)
+	for len(packets) < n {
+		select {
+		case packet := <-received:
+			packets = append(packets, packet)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d packets, want %d", len(packets), n)
+		}
+	}
+	return packets
+}
+
+//协商了压缩、校验和大包的连接，服务端和客户端的记录回放后服务器收到相同的包
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	serverRec, err := NewRecorder(filepath.Join(dir, "server.rec"), PROTO_BYTE, REC_SIDE_SERVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientRec, err := NewRecorder(filepath.Join(dir, "client.rec"), PROTO_BYTE, REC_SIDE_CLIENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser, received := newRecServer()
+	ser.SetRecorder(serverRec)
+	started := make(chan int, 1)
+	ser.Events.Start.Add(func(port int) { started <- port })
+	go ser.Listen(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	port := <-started
+	defer ser.getListener().Close()
+
+	client := NewTCPClient()
+	client.SetProto(PROTO_BYTE)
+	client.SetRecorder(clientRec)
+	client.Negotiate([]byte{PROTO_VERSION_1, PROTO_VERSION_2}, recFeatures)
+	negotiated := make(chan *Codec, 1)
+	client.Events.Negotiate.Add(func(codec *Codec) { negotiated <- codec })
+	if err := client.Connect(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if codec := <-negotiated; codec.Features != recFeatures {
+		t.Fatalf("negotiated %+v", codec)
+	}
+	//随机数据压缩后仍超过 0xFFFF，按大包发送
+	large := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(large)
+	payloads := [][]byte{[]byte("hello"), large, bytes.Repeat([]byte("abc"), 50000)}
+	for i, payload := range payloads {
+		if _, err := client.WriteMsg(byte(i+1), uint64(i), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := recvPackets(t, received, len(payloads))
+	serverRec.Close()
+	clientRec.Close()
+
+	for _, name := range []string{"server.rec", "client.rec"} {
+		ser, received := newRecServer()
+		if err := ReplayToServer(filepath.Join(dir, name), 0, ser); err != nil {
+			t.Fatal(name, err)
+		}
+		for i, packet := range recvPackets(t, received, len(want)) {
+			if !bytes.Equal(packet[HEAD_LEN:], want[i][HEAD_LEN:]) || packet[HEAD_MSGTYPE_POS] != want[i][HEAD_MSGTYPE_POS] {
+				t.Fatalf("%s: packet %d differs", name, i)
+			}
+		}
+	}
+}
+
+//版本1的记录文件没有记录端，按服务端读取
+func TestOpenRecordV1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v1.rec")
+	file := append([]byte(REC_MAGIC), 1, byte(PROTO_JSON))
+	file = append(file, REC_IN)
+	file = binary.BigEndian.AppendUint64(file, uint64(time.Now().UnixNano()))
+	file = binary.BigEndian.AppendUint64(file, 1)
+	file = binary.BigEndian.AppendUint32(file, 2)
+	file = append(file, "{}"...)
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := OpenRecord(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.Side != REC_SIDE_SERVER || reader.ProtoType != PROTO_JSON {
+		t.Fatalf("side %d proto %d", reader.Side, reader.ProtoType)
+	}
+	if rec, err := reader.Next(); err != nil || string(rec.Data) != "{}" {
+		t.Fatal(rec, err)
+	}
+}
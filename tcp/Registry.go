@@ -0,0 +1,200 @@
+package tcp
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//在线连接表和房间，连接建立时登记，Close 时移除并退出所有房间
+type registry struct {
+	clients map[uint64]*Client
+	rooms   map[string]map[uint64]*Client
+	lock    *sync.RWMutex
+}
+
+func newRegistry() *registry {
+	return &registry{
+		clients: make(map[uint64]*Client),
+		rooms:   make(map[string]map[uint64]*Client),
+		lock:    new(sync.RWMutex),
+	}
+}
+
+func (self *registry) add(client *Client) {
+	self.lock.Lock()
+	self.clients[client.id] = client
+	self.lock.Unlock()
+}
+
+func (self *registry) remove(client *Client) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.clients, client.id)
+	for room := range client.rooms {
+		self.leave(room, client)
+	}
+}
+
+//需持有写锁
+func (self *registry) leave(room string, client *Client) {
+	delete(client.rooms, room)
+	members := self.rooms[room]
+	if members == nil {
+		return
+	}
+	delete(members, client.id)
+	if len(members) == 0 {
+		delete(self.rooms, room)
+	}
+}
+
+//在线连接
+func (ser *TCPServer) Clients() []*Client {
+	ser.registry.lock.RLock()
+	defer ser.registry.lock.RUnlock()
+	clients := make([]*Client, 0, len(ser.registry.clients))
+	for _, client := range ser.registry.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+//按连接ID查找在线连接
+func (ser *TCPServer) GetClient(id uint64) *Client {
+	ser.registry.lock.RLock()
+	defer ser.registry.lock.RUnlock()
+	return ser.registry.clients[id]
+}
+
+//在线连接数
+func (ser *TCPServer) NumClients() int {
+	ser.registry.lock.RLock()
+	defer ser.registry.lock.RUnlock()
+	return len(ser.registry.clients)
+}
+
+//加入房间，连接关闭时自动退出
+func (ser *TCPServer) Join(room string, conn *Client) {
+	ser.registry.lock.Lock()
+	defer ser.registry.lock.Unlock()
+	if _, ok := ser.registry.clients[conn.id]; !ok {
+		//已关闭的连接
+		return
+	}
+	members := ser.registry.rooms[room]
+	if members == nil {
+		members = make(map[uint64]*Client)
+		ser.registry.rooms[room] = members
+	}
+	members[conn.id] = conn
+	if conn.rooms == nil {
+		conn.rooms = make(map[string]struct{}, 1)
+	}
+	conn.rooms[room] = struct{}{}
+}
+
+//退出房间
+func (ser *TCPServer) Leave(room string, conn *Client) {
+	ser.registry.lock.Lock()
+	defer ser.registry.lock.Unlock()
+	ser.registry.leave(room, conn)
+}
+
+//所有房间名
+func (ser *TCPServer) RoomNames() []string {
+	ser.registry.lock.RLock()
+	defer ser.registry.lock.RUnlock()
+	names := make([]string, 0, len(ser.registry.rooms))
+	for name := range ser.registry.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//房间成员
+func (ser *TCPServer) RoomMembers(room string) []*Client {
+	ser.registry.lock.RLock()
+	defer ser.registry.lock.RUnlock()
+	members := make([]*Client, 0, len(ser.registry.rooms[room]))
+	for _, client := range ser.registry.rooms[room] {
+		members = append(members, client)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].id < members[j].id })
+	return members
+}
+
+//向房间内所有连接写入完整的包，room 为空时发给所有在线连接，返回写成功的连接数
+func (ser *TCPServer) Broadcast(room string, data []byte) int {
+	var clients []*Client
+	if room == "" {
+		clients = ser.Clients()
+	} else {
+		clients = ser.RoomMembers(room)
+	}
+	sent := 0
+	for _, client := range clients {
+		if _, err := client.Write(data); err == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+//连接的流量统计
+type ClientStats struct {
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
+	PacketsIn  uint64 `json:"packets_in"`
+	PacketsOut uint64 `json:"packets_out"`
+}
+
+type clientStats struct {
+	bytesIn    uint64
+	bytesOut   uint64
+	packetsIn  uint64
+	packetsOut uint64
+}
+
+func (self *clientStats) in(n int) {
+	atomic.AddUint64(&self.bytesIn, uint64(n))
+	atomic.AddUint64(&self.packetsIn, 1)
+}
+
+func (self *clientStats) out(n int) {
+	atomic.AddUint64(&self.bytesOut, uint64(n))
+	atomic.AddUint64(&self.packetsOut, 1)
+}
+
+//收发的字节数和包数，收到的包按拆出的包计数，发出的按 Write 调用计数
+func (self *Client) Stats() ClientStats {
+	return ClientStats{
+		BytesIn:    atomic.LoadUint64(&self.stats.bytesIn),
+		BytesOut:   atomic.LoadUint64(&self.stats.bytesOut),
+		PacketsIn:  atomic.LoadUint64(&self.stats.packetsIn),
+		PacketsOut: atomic.LoadUint64(&self.stats.packetsOut),
+	}
+}
+
+//连接建立的时间
+func (self *Client) ConnectTime() time.Time {
+	return time.Unix(self.date, 0)
+}
+
+//加入的房间
+func (self *Client) Rooms() []string {
+	if self.server == nil {
+		return nil
+	}
+	self.server.registry.lock.RLock()
+	defer self.server.registry.lock.RUnlock()
+	rooms := make([]string, 0, len(self.rooms))
+	for room := range self.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
@@ -0,0 +1,259 @@
+package tcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+//可靠传输消息类型
+const (
+	MSG_RELIABLE byte = 0xF7 //可靠消息 Targetid 为序号，数据为内层的完整包
+	MSG_ACK      byte = 0xF8 //确认 Targetid 为确认的序号
+	MSG_EPOCH    byte = 0xF9 //发送方的序号纪元 Targetid 为纪元，纪元变化后接收方清空去重状态
+)
+
+const (
+	RELIABLE_TIMEOUT = 3 * time.Second //未确认多久后重发
+	RELIABLE_RETRY   = 5               //最多重发次数，超过后回调 OnExpire
+	RELIABLE_WINDOW  = 4096            //接收端去重窗口
+)
+
+var ErrReliableClosed = errors.New("reliable closed")
+
+//待确认的消息
+type reliableMsg struct {
+	data    []byte //业务数据，回调时使用
+	inner   []byte //内层的完整包，每次发送时按连接当前的协商结果封包
+	sentAt  time.Time
+	retries int
+}
+
+//至少一次送达的可靠层，发出的消息在确认前按超时重发，接收端回复确认并去重
+type Reliable struct {
+	write     func(msgtype byte, targetid uint64, data []byte) (int, error)
+	epoch     uint64 //序号纪元，每个 Reliable 不同，序号在纪元内唯一
+	seq       uint64
+	pending   map[uint64]*reliableMsg
+	recvEpoch uint64              //对端的序号纪元
+	recvMax   uint64              //收到的最大序号
+	recvSeen  map[uint64]struct{} //去重窗口内收到的序号
+	lock      *sync.Mutex
+	running   bool //重发协程是否已启动
+	closed    chan struct{}
+	Timeout   time.Duration
+	MaxRetry  int
+	OnAck     func(seq uint64, data []byte) //消息被确认
+	OnExpire  func(seq uint64, data []byte) //重发次数用完仍未确认
+}
+
+//创建可靠层，write 为底层连接按协商结果封包的写方法，例如 Client.WriteMsg，收到的包需要调用 Input
+//Timeout 等参数需在第一次 Send 之前设置
+func NewReliable(write func(msgtype byte, targetid uint64, data []byte) (int, error)) *Reliable {
+	var buf [8]byte
+	rand.Read(buf[:])
+	self := &Reliable{
+		write:    write,
+		epoch:    binary.BigEndian.Uint64(buf[:]) | 1,
+		pending:  make(map[uint64]*reliableMsg),
+		recvSeen: make(map[uint64]struct{}),
+		lock:     new(sync.Mutex),
+		closed:   make(chan struct{}),
+		Timeout:  RELIABLE_TIMEOUT,
+		MaxRetry: RELIABLE_RETRY,
+		OnAck:    func(seq uint64, data []byte) {},
+		OnExpire: func(seq uint64, data []byte) {},
+	}
+	return self
+}
+
+//在 TCPClient 上创建可靠层，客户端需使用 PROTO_BYTE 协议
+//收到的可靠消息去掉外层后交给 OnData，断线重连后未确认的消息继续重发
+//每次连接成功后在其它 Connect 监听器之前发送纪元，服务端为新连接创建的可靠层序号从头开始，不会被当作重复丢弃
+func NewClientReliable(client *TCPClient) *Reliable {
+	self := NewReliable(client.WriteMsg)
+	client.Events.Connect.AddOrder(-1, func() { self.SendEpoch() })
+	client.addFilter(func(data []byte) []byte {
+		if inner, ok := self.Input(data); ok {
+			return inner
+		}
+		return data
+	})
+	return self
+}
+
+//在服务端连接上创建可靠层，需要在服务器的 OnData 中调用 Input，在 OnClose/OnError 中调用 Close
+//创建时向客户端发送纪元，客户端重连后清空上一个连接的去重状态
+func NewServerReliable(client *Client) *Reliable {
+	self := NewReliable(client.WriteMsg)
+	self.SendEpoch()
+	return self
+}
+
+//向对端发送本端的序号纪元，需要在每个新连接上、第一个可靠消息之前发送
+func (self *Reliable) SendEpoch() error {
+	_, err := self.write(MSG_EPOCH, self.epoch, nil)
+	return err
+}
+
+//可靠发送，按连接协商的编解码方式封包，返回消息序号，Close 之后返回 ErrReliableClosed
+func (self *Reliable) Send(msgtype byte, targetid uint64, data []byte) (uint64, error) {
+	if int(HEAD_LEN)*2+len(data) > 0xFFFF {
+		return 0, TO_LAGER
+	}
+	//长度已检查，封包不会出错
+	inner, _ := AppendFrame(make([]byte, 0, int(HEAD_LEN)+len(data)), PROTO_VERSION_1, msgtype, targetid, data)
+	self.lock.Lock()
+	select {
+	case <-self.closed:
+		self.lock.Unlock()
+		return 0, ErrReliableClosed
+	default:
+	}
+	self.seq++
+	seq := self.seq
+	msg := &reliableMsg{
+		data:   inner[HEAD_LEN:],
+		inner:  inner,
+		sentAt: time.Now(),
+	}
+	self.pending[seq] = msg
+	if !self.running {
+		self.running = true
+		go self.retransmit()
+	}
+	self.lock.Unlock()
+	//写失败不返回错误，等待超时重发
+	self.write(MSG_RELIABLE, seq, inner)
+	return seq, nil
+}
+
+//处理收到的包，不是可靠层的包 handled 为false
+//收到可靠消息时回复确认，并返回内层包，重复的消息 inner 为nil
+func (self *Reliable) Input(packet []byte) (inner []byte, handled bool) {
+	if uint32(len(packet)) < HEAD_LEN {
+		return nil, false
+	}
+	seq := binary.BigEndian.Uint64(packet[HEAD_TARGETID_POS:])
+	switch packet[HEAD_MSGTYPE_POS] {
+	case MSG_ACK:
+		self.lock.Lock()
+		msg := self.pending[seq]
+		delete(self.pending, seq)
+		self.lock.Unlock()
+		if msg != nil {
+			self.OnAck(seq, msg.data)
+		}
+		return nil, true
+	case MSG_RELIABLE:
+		//重复的消息也要确认，上次的确认可能丢失了
+		self.write(MSG_ACK, seq, nil)
+		if uint32(len(packet)) < HEAD_LEN*2 || self.duplicate(seq) {
+			return nil, true
+		}
+		return packet[HEAD_LEN:], true
+	case MSG_EPOCH:
+		self.lock.Lock()
+		if seq != self.recvEpoch {
+			//对端换了纪元，序号从头开始
+			self.recvEpoch = seq
+			self.recvMax = 0
+			self.recvSeen = make(map[uint64]struct{})
+		}
+		self.lock.Unlock()
+		return nil, true
+	}
+	return nil, false
+}
+
+//检查是否重复，并记录序号
+func (self *Reliable) duplicate(seq uint64) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.recvMax >= RELIABLE_WINDOW && seq <= self.recvMax-RELIABLE_WINDOW {
+		//早于去重窗口的当作重复
+		return true
+	}
+	if _, ok := self.recvSeen[seq]; ok {
+		return true
+	}
+	self.recvSeen[seq] = struct{}{}
+	if seq > self.recvMax {
+		self.recvMax = seq
+		if len(self.recvSeen) > RELIABLE_WINDOW*2 {
+			for s := range self.recvSeen {
+				if s+RELIABLE_WINDOW <= self.recvMax {
+					delete(self.recvSeen, s)
+				}
+			}
+		}
+	}
+	return false
+}
+
+//未确认的消息数
+func (self *Reliable) Pending() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.pending)
+}
+
+//停止重发，未确认的消息回调 OnExpire，之后的 Send 返回 ErrReliableClosed
+func (self *Reliable) Close() {
+	self.lock.Lock()
+	select {
+	case <-self.closed:
+		self.lock.Unlock()
+		return
+	default:
+		close(self.closed)
+	}
+	pending := self.pending
+	self.pending = make(map[uint64]*reliableMsg)
+	self.lock.Unlock()
+	for seq, msg := range pending {
+		self.OnExpire(seq, msg.data)
+	}
+}
+
+//定时检查超时的消息并重发
+func (self *Reliable) retransmit() {
+	interval := self.Timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.closed:
+			return
+		case now := <-ticker.C:
+			resend := make(map[uint64][]byte)
+			expired := make(map[uint64]*reliableMsg)
+			self.lock.Lock()
+			for seq, msg := range self.pending {
+				if now.Sub(msg.sentAt) < self.Timeout {
+					continue
+				}
+				if msg.retries >= self.MaxRetry {
+					delete(self.pending, seq)
+					expired[seq] = msg
+					continue
+				}
+				msg.retries++
+				msg.sentAt = now
+				resend[seq] = msg.inner
+			}
+			self.lock.Unlock()
+			for seq, inner := range resend {
+				self.write(MSG_RELIABLE, seq, inner)
+			}
+			for seq, msg := range expired {
+				self.OnExpire(seq, msg.data)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package tcp
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//一对直接相连的可靠层，drop 返回 true 的包被丢弃
+func reliablePair(drop func(msgtype byte) bool) (a, b *Reliable) {
+	var lock sync.Mutex
+	link := func(peer **Reliable) func(msgtype byte, targetid uint64, data []byte) (int, error) {
+		return func(msgtype byte, targetid uint64, data []byte) (int, error) {
+			lock.Lock()
+			dropped := drop != nil && drop(msgtype)
+			lock.Unlock()
+			if !dropped {
+				packet, _ := AppendFrame(nil, PROTO_VERSION_1, msgtype, targetid, data)
+				(*peer).Input(packet)
+			}
+			return len(data), nil
+		}
+	}
+	a = NewReliable(link(&b))
+	b = NewReliable(link(&a))
+	a.Timeout, b.Timeout = 20*time.Millisecond, 20*time.Millisecond
+	return
+}
+
+func TestReliableAck(t *testing.T) {
+	a, b := reliablePair(nil)
+	defer a.Close()
+	acked := make(chan uint64, 1)
+	a.OnAck = func(seq uint64, data []byte) { acked <- seq }
+	seq, err := a.Send(1, 2, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-acked; got != seq || a.Pending() != 0 {
+		t.Fatalf("acked %d, want %d, pending %d", got, seq, a.Pending())
+	}
+	//重复的消息仍然确认，但不再交给上层
+	packet, _ := AppendFrame(nil, PROTO_VERSION_1, MSG_RELIABLE, seq, WarpData(1, []byte("hello")))
+	if inner, handled := b.Input(packet); !handled || inner != nil {
+		t.Fatal("duplicate delivered")
+	}
+	//对端换了纪元后同样的序号是新消息
+	epoch, _ := AppendFrame(nil, PROTO_VERSION_1, MSG_EPOCH, 7, nil)
+	b.Input(epoch)
+	if inner, _ := b.Input(packet); inner == nil {
+		t.Fatal("message after new epoch dropped")
+	}
+	if _, handled := b.Input(WarpData(1, nil)); handled {
+		t.Fatal("plain packet handled")
+	}
+}
+
+//丢失的消息超时后重发，确认后不再重发
+func TestReliableRetransmit(t *testing.T) {
+	sent := 0
+	a, _ := reliablePair(func(msgtype byte) bool {
+		if msgtype != MSG_RELIABLE {
+			return false
+		}
+		sent++
+		return sent == 1
+	})
+	defer a.Close()
+	acked := make(chan uint64, 1)
+	a.OnAck = func(seq uint64, data []byte) { acked <- seq }
+	a.Send(1, 2, []byte("hello"))
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatal("not retransmitted")
+	}
+	time.Sleep(3 * a.Timeout)
+	if a.Pending() != 0 {
+		t.Fatalf("pending %d", a.Pending())
+	}
+}
+
+//重发次数用完后回调 OnExpire
+func TestReliableExpire(t *testing.T) {
+	a, _ := reliablePair(func(msgtype byte) bool { return msgtype == MSG_RELIABLE })
+	defer a.Close()
+	a.MaxRetry = 2
+	expired := make(chan string, 1)
+	a.OnExpire = func(seq uint64, data []byte) { expired <- string(data) }
+	a.Send(1, 2, []byte("hello"))
+	select {
+	case data := <-expired:
+		if data != "hello" || a.Pending() != 0 {
+			t.Fatalf("expired %q, pending %d", data, a.Pending())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnExpire not called")
+	}
+}
+
+//关闭时未确认的消息回调 OnExpire，之后的发送返回错误
+func TestReliableClose(t *testing.T) {
+	a, _ := reliablePair(func(msgtype byte) bool { return msgtype == MSG_RELIABLE })
+	a.Timeout = time.Hour
+	expired := 0
+	a.OnExpire = func(seq uint64, data []byte) { expired++ }
+	a.Send(1, 2, []byte("a"))
+	a.Send(1, 2, []byte("b"))
+	a.Close()
+	if expired != 2 {
+		t.Fatalf("expired %d", expired)
+	}
+	if _, err := a.Send(1, 2, []byte("c")); err != ErrReliableClosed {
+		t.Fatalf("want ErrReliableClosed, got %v", err)
+	}
+	if a.Pending() != 0 {
+		t.Fatalf("pending %d", a.Pending())
+	}
+	a.Close()
+}
@@ -0,0 +1,300 @@
+package tcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+//会话恢复消息类型
+const (
+	MSG_TOKEN       byte = 0xF2 //服务器下发恢复令牌 数据: 令牌
+	MSG_RESUME      byte = 0xF3 //客户端请求恢复会话 数据: 最后收到的序号(8字节)|令牌
+	MSG_RESUME_OK   byte = 0xF4 //恢复成功，随后补发断线期间的包
+	MSG_RESUME_FAIL byte = 0xF5 //恢复失败，会话已过期需要重新登录
+	MSG_SEQ         byte = 0xF6 //带序号的包 Targetid 为序号，数据为内层的完整包
+)
+
+const (
+	SESSION_GRACE   = 60 * time.Second //断线后会话保留时间
+	SESSION_HISTORY = 1024             //每个会话保留用于补发的包数
+)
+
+//会话管理器，断线的连接在宽限期内可以凭令牌恢复属性和未收到的包
+type SessionManager struct {
+	sessions map[string]*Session
+	lock     *sync.Mutex
+	Grace    time.Duration                        //断线后会话保留时间
+	History  int                                  //每个会话保留用于补发的包数
+	OnResume func(conn *Client, session *Session) //会话恢复到新连接后回调，可在这里恢复业务状态
+	OnExpire func(session *Session)               //会话过期后回调
+}
+
+//开启会话恢复，只对 PROTO_BYTE 有效
+func (ser *TCPServer) EnableResume(grace time.Duration) *SessionManager {
+	ser.sessions = &SessionManager{
+		sessions: make(map[string]*Session),
+		lock:     new(sync.Mutex),
+		Grace:    grace,
+		History:  SESSION_HISTORY,
+		OnResume: func(conn *Client, session *Session) {},
+		OnExpire: func(session *Session) {},
+	}
+	return ser.sessions
+}
+
+//会话管理器，未开启时为nil
+func (ser *TCPServer) Sessions() *SessionManager {
+	return ser.sessions
+}
+
+//登录成功后为连接创建会话，并把恢复令牌下发给客户端，连接已有的会话会被注销
+func (self *SessionManager) Issue(conn *Client) *Session {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	session := &Session{
+		token:    hex.EncodeToString(buf),
+		manager:  self,
+		client:   conn,
+		frames:   make([]seqFrame, 0, 16),
+		lock:     new(sync.Mutex),
+		sendLock: new(sync.Mutex),
+	}
+	//重复登录时注销旧会话
+	if old := conn.Session(); old != nil {
+		self.Remove(old)
+	}
+	self.lock.Lock()
+	self.sessions[session.token] = session
+	self.lock.Unlock()
+	conn.setSession(session)
+	conn.Write(WarpData(MSG_TOKEN, []byte(session.token)))
+	return session
+}
+
+//按令牌查找会话
+func (self *SessionManager) Get(token string) *Session {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.sessions[token]
+}
+
+//会话数量
+func (self *SessionManager) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.sessions)
+}
+
+//注销会话，例如用户主动退出
+//连接的会话和会话的连接都在 session.lock 内清除，与连接关闭时的 detach 互斥
+func (self *SessionManager) Remove(session *Session) {
+	self.lock.Lock()
+	delete(self.sessions, session.token)
+	self.lock.Unlock()
+	session.lock.Lock()
+	if session.timer != nil {
+		session.timer.Stop()
+	}
+	if session.client != nil {
+		session.client.setSession(nil)
+		session.client = nil
+	}
+	session.lock.Unlock()
+}
+
+//处理客户端的恢复请求
+//客户端确认的序号早于保留的最早的包时无法补全，回复 MSG_RESUME_FAIL 并删除会话
+func (self *SessionManager) resume(conn *Client, packet []byte) {
+	data := packet[HEAD_LEN:]
+	var session *Session
+	if len(data) > 8 {
+		session = self.Get(string(data[8:]))
+	}
+	if session == nil {
+		conn.Write(WarpData(MSG_RESUME_FAIL, nil))
+		return
+	}
+	lastSeq := binary.BigEndian.Uint64(data)
+	//补发期间不能插入新的包，否则客户端会按序号丢弃较早的包
+	session.sendLock.Lock()
+	defer session.sendLock.Unlock()
+	session.lock.Lock()
+	if !session.canReplay(lastSeq) {
+		session.lock.Unlock()
+		self.Remove(session)
+		conn.Write(WarpData(MSG_RESUME_FAIL, nil))
+		self.OnExpire(session)
+		return
+	}
+	if session.timer != nil {
+		session.timer.Stop()
+		session.timer = nil
+	}
+	rooms := session.rooms
+	old := session.client
+	if old != nil && old != conn {
+		//旧连接可能还没有检测到断开
+		rooms = old.Rooms()
+		old.setSession(nil)
+		old.Close()
+	}
+	if old != nil {
+		conn.attrs.copyFrom(old.attrs)
+	} else if session.attrs != nil {
+		conn.attrs.copyFrom(session.attrs)
+	}
+	session.attrs = nil
+	session.rooms = nil
+	session.client = conn
+	conn.setSession(session)
+	var replay []seqFrame
+	for _, frame := range session.frames {
+		if frame.seq > lastSeq {
+			replay = append(replay, frame)
+		}
+	}
+	session.lock.Unlock()
+	if conn.server != nil {
+		for _, room := range rooms {
+			conn.server.Join(room, conn)
+		}
+	}
+	conn.Write(WarpData(MSG_RESUME_OK, nil))
+	//补发客户端没有收到的包
+	for _, frame := range replay {
+		conn.WriteMsg(MSG_SEQ, frame.seq, frame.inner)
+	}
+	self.OnResume(conn, session)
+}
+
+//过期删除会话
+func (self *SessionManager) expire(session *Session) {
+	session.lock.Lock()
+	detached := session.client == nil
+	session.lock.Unlock()
+	if !detached {
+		return
+	}
+	self.lock.Lock()
+	delete(self.sessions, session.token)
+	self.lock.Unlock()
+	self.OnExpire(session)
+}
+
+//已发送的带序号的包，补发时按新连接的协商结果封包
+type seqFrame struct {
+	seq   uint64
+	inner []byte
+}
+
+//会话，跨重连保留连接属性和发出的包
+type Session struct {
+	token    string
+	manager  *SessionManager
+	client   *Client    //当前连接，断线期间为nil
+	attrs    *Attrs     //断线期间保存的连接属性
+	rooms    []string   //断线期间保存的房间，恢复后重新加入
+	seq      uint64     //最后发出的序号
+	frames   []seqFrame //最近发出的包，用于补发
+	timer    *time.Timer
+	lock     *sync.Mutex
+	sendLock *sync.Mutex //保证包按序号顺序写出，写连接时不持有 lock
+}
+
+func (self *Session) Token() string {
+	return self.token
+}
+
+//当前连接，断线期间返回nil
+func (self *Session) Client() *Client {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.client
+}
+
+//发送带序号的包，按连接协商的编解码方式封包，断线期间的包会在恢复后补发
+func (self *Session) Send(msgtype byte, targetid uint64, data []byte) error {
+	if int(HEAD_LEN)*2+len(data) > 0xFFFF {
+		return TO_LAGER
+	}
+	//长度已检查，封包不会出错
+	inner, _ := AppendFrame(make([]byte, 0, int(HEAD_LEN)+len(data)), PROTO_VERSION_1, msgtype, targetid, data)
+	self.sendLock.Lock()
+	defer self.sendLock.Unlock()
+	self.lock.Lock()
+	self.seq++
+	seq := self.seq
+	self.frames = append(self.frames, seqFrame{seq: seq, inner: inner})
+	if history := self.manager.History; history > 0 && len(self.frames) > history {
+		self.frames = append(self.frames[:0], self.frames[len(self.frames)-history:]...)
+	}
+	client := self.client
+	self.lock.Unlock()
+	if client != nil {
+		client.WriteMsg(MSG_SEQ, seq, inner)
+	}
+	return nil
+}
+
+//客户端确认到 lastSeq 时，之后的包是否都还保留着，需持有锁
+func (self *Session) canReplay(lastSeq uint64) bool {
+	if lastSeq >= self.seq {
+		return true
+	}
+	return len(self.frames) > 0 && self.frames[0].seq <= lastSeq+1
+}
+
+//连接断开，开始计算宽限期
+func (self *Session) detach(conn *Client) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.client != conn {
+		return
+	}
+	self.attrs = conn.attrs
+	self.rooms = conn.Rooms()
+	self.client = nil
+	self.timer = time.AfterFunc(self.manager.Grace, func() { self.manager.expire(self) })
+}
+
+//客户端的会话恢复状态
+type resumeState struct {
+	token   string //服务器下发的恢复令牌
+	lastSeq uint64 //最后收到的序号
+	lock    sync.Mutex
+}
+
+//收到新令牌，序号重新开始
+func (self *resumeState) setToken(token string) {
+	self.lock.Lock()
+	self.token = token
+	self.lastSeq = 0
+	self.lock.Unlock()
+}
+
+//生成恢复请求包，没有令牌时返回nil
+func (self *resumeState) resumePacket() []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.token == "" {
+		return nil
+	}
+	data := make([]byte, 8, 8+len(self.token))
+	binary.BigEndian.PutUint64(data, self.lastSeq)
+	return WarpData(MSG_RESUME, append(data, self.token...))
+}
+
+//收到带序号的包，重复的返回nil，否则返回内层包
+func (self *resumeState) unwrap(packet []byte) []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	seq := binary.BigEndian.Uint64(packet[HEAD_TARGETID_POS:])
+	if seq <= self.lastSeq || uint32(len(packet)) < HEAD_LEN*2 {
+		return nil
+	}
+	self.lastSeq = seq
+	return packet[HEAD_LEN:]
+}
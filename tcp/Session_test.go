@@ -0,0 +1,189 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const msgLogin byte = 1
+
+//开启会话恢复的服务器，收到 msgLogin 时签发会话
+func newResumeServer(grace time.Duration) (*TCPServer, *SessionManager) {
+	ser := NewTCPServer()
+	ser.SetProto(PROTO_BYTE)
+	sessions := ser.EnableResume(grace)
+	ser.Events.Data.Add(func(conn *Client, data []byte) {
+		if data[HEAD_MSGTYPE_POS] == msgLogin {
+			sessions.Issue(conn)
+		}
+	})
+	return ser, sessions
+}
+
+//内存连接，服务器写出的包按顺序送入通道
+func resumeConn(ser *TCPServer) (net.Conn, chan []byte) {
+	server, client := net.Pipe()
+	go ser.ServeConn(server)
+	frames := make(chan []byte, 16)
+	go func() {
+		defer close(frames)
+		head := make([]byte, HEAD_LEN)
+		for {
+			if _, err := io.ReadFull(client, head); err != nil {
+				return
+			}
+			packet := make([]byte, HEAD_LEN+uint32(binary.BigEndian.Uint16(head[HEAD_PACKETLEN_POS:])))
+			copy(packet, head)
+			if _, err := io.ReadFull(client, packet[HEAD_LEN:]); err != nil {
+				return
+			}
+			frames <- packet
+		}
+	}()
+	return client, frames
+}
+
+func nextFrame(t *testing.T, frames chan []byte, msgtype byte) []byte {
+	select {
+	case packet := <-frames:
+		if packet == nil || packet[HEAD_MSGTYPE_POS] != msgtype {
+			t.Fatalf("got %v, want msgtype %#x", packet, msgtype)
+		}
+		return packet
+	case <-time.After(time.Second):
+		t.Fatalf("no packet, want msgtype %#x", msgtype)
+	}
+	return nil
+}
+
+//登录后断开，返回会话，令牌从 MSG_TOKEN 中取得
+func loginAndDrop(t *testing.T, ser *TCPServer, sessions *SessionManager) *Session {
+	conn, frames := resumeConn(ser)
+	conn.Write(WarpData(msgLogin, nil))
+	token := string(nextFrame(t, frames, MSG_TOKEN)[HEAD_LEN:])
+	session := sessions.Get(token)
+	if session == nil {
+		t.Fatal("session not issued")
+	}
+	session.Client().Set("uid", 7)
+	go session.Send(2, 0, []byte("a"))
+	nextFrame(t, frames, MSG_SEQ)
+	conn.Close()
+	eventually(t, func() bool { return session.Client() == nil })
+	return session
+}
+
+func resumePacket(lastSeq uint64, token string) []byte {
+	data := binary.BigEndian.AppendUint64(nil, lastSeq)
+	return WarpData(MSG_RESUME, append(data, token...))
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//宽限期内恢复，补发断线期间的包，属性随会话恢复
+func TestResumeWithinGrace(t *testing.T) {
+	ser, sessions := newResumeServer(time.Second)
+	resumed := make(chan *Session, 1)
+	sessions.OnResume = func(conn *Client, session *Session) { resumed <- session }
+	session := loginAndDrop(t, ser, sessions)
+	session.Send(2, 0, []byte("b"))
+	session.Send(2, 0, []byte("c"))
+	conn, frames := resumeConn(ser)
+	defer conn.Close()
+	conn.Write(resumePacket(1, session.Token()))
+	nextFrame(t, frames, MSG_RESUME_OK)
+	for seq, want := range []string{"b", "c"} {
+		packet := nextFrame(t, frames, MSG_SEQ)
+		if binary.BigEndian.Uint64(packet[HEAD_TARGETID_POS:]) != uint64(seq+2) || string(packet[HEAD_LEN*2:]) != want {
+			t.Fatalf("replayed %q", packet)
+		}
+	}
+	select {
+	case got := <-resumed:
+		if got != session || session.Client() == nil || session.Client().Session() != session || session.Client().GetInt("uid") != 7 {
+			t.Fatal("session not attached to the new connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnResume not called")
+	}
+}
+
+//宽限期过后会话被删除，恢复失败
+func TestResumeAfterExpiry(t *testing.T) {
+	ser, sessions := newResumeServer(10 * time.Millisecond)
+	expired := make(chan *Session, 1)
+	sessions.OnExpire = func(session *Session) { expired <- session }
+	session := loginAndDrop(t, ser, sessions)
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("OnExpire not called")
+	}
+	if sessions.Len() != 0 {
+		t.Fatalf("%d sessions left", sessions.Len())
+	}
+	conn, frames := resumeConn(ser)
+	defer conn.Close()
+	conn.Write(resumePacket(1, session.Token()))
+	nextFrame(t, frames, MSG_RESUME_FAIL)
+}
+
+//断线期间发出的包超过保留数，无法补全时恢复失败并删除会话
+func TestResumeHistoryGap(t *testing.T) {
+	ser, sessions := newResumeServer(time.Second)
+	sessions.History = 2
+	expired := make(chan *Session, 1)
+	sessions.OnExpire = func(session *Session) { expired <- session }
+	session := loginAndDrop(t, ser, sessions)
+	for i := 0; i < 3; i++ {
+		session.Send(2, 0, []byte("b"))
+	}
+	conn, frames := resumeConn(ser)
+	defer conn.Close()
+	conn.Write(resumePacket(1, session.Token()))
+	nextFrame(t, frames, MSG_RESUME_FAIL)
+	if sessions.Get(session.Token()) != nil {
+		t.Fatal("session not removed")
+	}
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("OnExpire not called")
+	}
+}
+
+//注销会话和关闭连接同时进行，用 -race 检查对 Client.session 的访问
+func TestRemoveWhileClosing(t *testing.T) {
+	ser, sessions := newResumeServer(time.Second)
+	for i := 0; i < 50; i++ {
+		conn, frames := resumeConn(ser)
+		conn.Write(WarpData(msgLogin, nil))
+		session := sessions.Get(string(nextFrame(t, frames, MSG_TOKEN)[HEAD_LEN:]))
+		client := session.Client()
+		done := make(chan struct{})
+		go func() {
+			client.Close()
+			close(done)
+		}()
+		sessions.Remove(session)
+		<-done
+		if session.Client() != nil {
+			t.Fatal("session still linked to the closed client")
+		}
+		conn.Close()
+	}
+	if sessions.Len() != 0 {
+		t.Fatalf("%d sessions left", sessions.Len())
+	}
+}
@@ -0,0 +1,232 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+const (
+	SNIFF_TIMEOUT     = 300 * time.Millisecond //默认等待首包的时间，超时的连接按 Protocoler 处理，服务器先发数据的协议会等待这么久
+	SNIFF_TLS_TIMEOUT = 5 * time.Second        //TLS握手的超时时间
+	SNIFF_BUF         = 4 * 1024
+)
+
+//嗅探结果
+const (
+	SNIFF_PROTO = iota //交给 Protocoler
+	SNIFF_HTTP         //交给 http.Handler
+	SNIFF_TLS          //TLS握手，解密后再嗅探一次
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+//单端口多协议的配置
+type sniffConfig struct {
+	handler http.Handler
+	tls     *tls.Config
+	http    *connListener //交给 http.Server 的连接
+	timeout time.Duration //等待首包的时间
+}
+
+//嗅探时保存在请求 context 中的TLS连接
+type sniffTLSKey struct{}
+
+//开启协议嗅探，同一端口上 HTTP 请求交给 handler，TLS 连接用 tlsConfig 握手后再按解密的内容分流，其它交给 Protocoler
+//handler 为nil时不分流HTTP，tlsConfig 为nil时不处理TLS，需在 Listen 之前调用，ListenEpoll 不支持嗅探
+//handler 中可以挂载 ser.ServeWS，websocket 升级后的连接和TCP连接一样产生 *Client
+//tlsConfig 没有设置 NextProtos 时会加上 h2 和 http/1.1，ALPN 协商出HTTP的TLS连接直接交给 http.Server，可以使用HTTP/2
+//自定义协议的客户端不要发送 ALPN，或者把自己的协议名加到 tlsConfig.NextProtos 中，否则握手会失败
+func (ser *TCPServer) SetSniff(handler http.Handler, tlsConfig *tls.Config) {
+	config := &sniffConfig{handler: handler, tls: tlsConfig, timeout: SNIFF_TIMEOUT}
+	if handler != nil {
+		if tlsConfig != nil && len(tlsConfig.NextProtos) == 0 {
+			config.tls = tlsConfig.Clone()
+			config.tls.NextProtos = []string{"h2", "http/1.1"}
+		}
+		config.http = newConnListener()
+		server := &http.Server{
+			Handler: withSniffTLS(handler),
+			ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+				if pc, ok := conn.(*peekConn); ok {
+					if tlsConn, ok := pc.Conn.(*tls.Conn); ok {
+						return context.WithValue(ctx, sniffTLSKey{}, tlsConn)
+					}
+				}
+				return ctx
+			},
+		}
+		go func() {
+			if err := server.Serve(config.http); err != nil && err != net.ErrClosed {
+				logger.Error("嗅探的HTTP服务异常:", err)
+			}
+		}()
+	}
+	ser.sniff = config
+}
+
+//设置等待首包的时间，默认 SNIFF_TIMEOUT，需在 SetSniff 之后调用
+//服务器先发数据的协议(客户端连上后等待服务器问候)会在这个时间后才交给 Protocoler，这类协议应设置得尽量短
+func (ser *TCPServer) SetSniffTimeout(timeout time.Duration) {
+	if ser.sniff != nil {
+		ser.sniff.timeout = timeout
+	}
+}
+
+//没有协商 ALPN 的TLS连接嗅探时读走了数据，交给 http.Server 的是包装后的连接，这里补上 r.TLS
+func withSniffTLS(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			if tlsConn, ok := r.Context().Value(sniffTLSKey{}).(*tls.Conn); ok {
+				state := tlsConn.ConnectionState()
+				r.TLS = &state
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+//Listen 接受的连接，开启嗅探时先判断协议
+func (ser *TCPServer) serve(conn net.Conn) {
+	if ser.sniff == nil {
+		ser.ServeConn(conn)
+		return
+	}
+	ser.sniffConn(conn, true)
+}
+
+func (ser *TCPServer) sniffConn(conn net.Conn, allowTLS bool) {
+	pc := newPeekConn(conn)
+	kind, err := pc.sniff(ser.sniff.timeout)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	switch {
+	case kind == SNIFF_TLS && allowTLS && ser.sniff.tls != nil:
+		tlsConn := tls.Server(pc, ser.sniff.tls)
+		tlsConn.SetDeadline(time.Now().Add(SNIFF_TLS_TIMEOUT))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Debug(conn.RemoteAddr(), "TLS握手失败:", err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		//ALPN 已确定是HTTP时不再嗅探，直接交出 *tls.Conn，http.Server 据此设置 r.TLS 并切换 HTTP/2
+		if proto := tlsConn.ConnectionState().NegotiatedProtocol; ser.sniff.http != nil && (proto == "h2" || proto == "http/1.1") {
+			if !ser.sniff.http.push(tlsConn) {
+				conn.Close()
+			}
+			return
+		}
+		ser.sniffConn(tlsConn, false)
+	case kind == SNIFF_HTTP && ser.sniff.http != nil:
+		if !ser.sniff.http.push(pc) {
+			conn.Close()
+		}
+	default:
+		ser.ServeConn(pc)
+	}
+}
+
+//可以预读而不消耗数据的连接
+type peekConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{Conn: conn, reader: bufio.NewReaderSize(conn, SNIFF_BUF)}
+}
+
+//先读预读的数据，读完后直接读连接，避免多一次拷贝
+func (self *peekConn) Read(b []byte) (int, error) {
+	if self.reader.Buffered() > 0 {
+		return self.reader.Read(b)
+	}
+	return self.Conn.Read(b)
+}
+
+//根据首包判断协议，timeout 内没有收到数据时按 SNIFF_PROTO 处理
+func (self *peekConn) sniff(timeout time.Duration) (int, error) {
+	self.Conn.SetReadDeadline(time.Now().Add(timeout))
+	defer self.Conn.SetReadDeadline(time.Time{})
+	for n := 1; ; n++ {
+		data, err := self.reader.Peek(n)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return SNIFF_PROTO, nil
+			}
+			return SNIFF_PROTO, err
+		}
+		if n == 1 {
+			if data[0] == 0x16 {
+				return SNIFF_TLS, nil
+			}
+			if data[0] < 'A' || data[0] > 'Z' {
+				return SNIFF_PROTO, nil
+			}
+		}
+		//请求方法加空格完整后才确定是HTTP
+		partial := false
+		for _, method := range httpMethods {
+			if len(data) <= len(method) && bytes.Equal(data, method[:len(data)]) {
+				if len(data) == len(method) {
+					return SNIFF_HTTP, nil
+				}
+				partial = true
+			}
+		}
+		if !partial {
+			return SNIFF_PROTO, nil
+		}
+	}
+}
+
+//把嗅探出的连接交给 http.Server 的监听器
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (self *connListener) push(conn net.Conn) bool {
+	select {
+	case self.conns <- conn:
+		return true
+	case <-self.closed:
+		return false
+	}
+}
+
+func (self *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (self *connListener) Close() error {
+	self.once.Do(func() { close(self.closed) })
+	return nil
+}
+
+func (self *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
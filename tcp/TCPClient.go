@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,27 +15,48 @@ var (
 )
 
 type TCPClient struct {
-	conn          *net.TCPConn
+	conn          net.Conn
 	OnConnect     func()
 	OnClose       func()
 	OnError       func(err error)
 	OnData        func(data []byte)
 	buf           *bytes.Buffer
 	seraddr       *net.TCPAddr
-	heartDuration int    //心跳间隔时间
-	heartPage     []byte //心跳数据包
+	addrs         []string //服务器地址列表，连接失败时依次尝试下一个
+	addrIdx       int      //上次连接成功的地址下标，重连时优先使用
+	dialer        Dialer   //拨号器，默认直连
+	heartDuration int      //心跳间隔时间
+	heartPage     []byte   //心跳数据包
 	isClosed      bool
-	status        int //1心跳  2重连  0关闭
+	status        int                             //1心跳  2重连  0关闭
+	protoType     int                             //分包协议类型
+	proto         Protocoler                      //PROTO_BYTE 时用于拆包
+	recorder      *Recorder                       //会话记录器
+	connSeq       uint64                          //连接次数，记录时作为连接ID区分每次重连
+	versions      []byte                          //握手时声明支持的版本，为空不握手
+	features      uint32                          //握手时声明支持的特性
+	codec         atomic.Value                    //协商后的编解码方式 *Codec
+	resume        resumeState                     //会话恢复状态
+	Events        ClientEvents                    //类型安全的事件，可注册多个监听器
+	on            onListeners                     //On 注册的监听器
+	filters       event[func(data []byte) []byte] //Mux、Reliable 等包装在 OnData 之前处理自己的包
+	OnNegotiate   func(codec *Codec)
+	OnResume      func(ok bool) //重连后会话恢复的结果，失败需要重新登录
 }
 
 func NewTCPClient() (self *TCPClient) {
 	self = new(TCPClient)
-	self.OnConnect = func() {}
-	self.OnClose = func() {}
-	self.OnError = func(err error) {}
-	self.OnData = func(data []byte) {}
+	//默认把事件分发给 Events 中的监听器，直接给 OnXxx 赋值会替换掉这些监听器
+	self.OnConnect = self.Events.Connect.Emit
+	self.OnClose = self.Events.Close.Emit
+	self.OnError = self.Events.Error.Emit
+	self.OnData = self.Events.Data.Emit
+	self.OnNegotiate = self.Events.Negotiate.Emit
+	self.OnResume = self.Events.Resume.Emit
+	self.codec.Store(defaultCodec)
 	self.heartPage = make([]byte, 0)
 	self.heartDuration = 20
+	self.dialer = &DirectDialer{Timeout: DIAL_TIMEOUT}
 	return
 }
 
@@ -69,11 +91,96 @@ func (self *TCPClient) SetKeepAlive(second int, data []byte) {
 	self.status = 1
 }
 
+//设置分包协议，PROTO_JSON 或 PROTO_BYTE，默认 PROTO_JSON，需在 Connect 之前调用
+func (self *TCPClient) SetProto(protoType int) {
+	self.protoType = protoType
+}
+
+//设置会话记录器，记录器需用 REC_SIDE_CLIENT 创建，nil 关闭记录
+func (self *TCPClient) SetRecorder(recorder *Recorder) {
+	self.recorder = recorder
+}
+
+//设置握手时声明支持的版本和特性，每次连接成功后自动握手，只对 PROTO_BYTE 有效
+//握手完成前按版本1收发，完成后回调 OnNegotiate
+func (self *TCPClient) Negotiate(versions []byte, features uint32) {
+	self.versions = versions
+	self.features = features
+}
+
+//协商后的编解码方式，未协商时为版本1
+func (self *TCPClient) Codec() *Codec {
+	return self.codec.Load().(*Codec)
+}
+
+//按协商结果封包并写出
+func (self *TCPClient) WriteMsg(msgtype byte, targetid uint64, data []byte) (n int, err error) {
+	packet, err := self.Codec().Encode(msgtype, targetid, data)
+	if err != nil {
+		return 0, err
+	}
+	return self.Write(packet)
+}
+
+//回调收到的包
+func (self *TCPClient) dispatch(data []byte) {
+	if self.recorder != nil {
+		self.recorder.Record(self.connSeq, REC_IN, data)
+	}
+	if self.protoType == PROTO_BYTE {
+		switch data[HEAD_MSGTYPE_POS] {
+		case MSG_HELLO_OK:
+			codec, err := parseHelloOk(data)
+			if err != nil {
+				self.OnError(err)
+				return
+			}
+			self.codec.Store(codec)
+			self.proto.(*ByteProto).SetCodec(codec)
+			self.OnNegotiate(codec)
+			return
+		case MSG_TOKEN:
+			self.resume.setToken(string(data[HEAD_LEN:]))
+			return
+		case MSG_RESUME_OK:
+			self.OnResume(true)
+			return
+		case MSG_RESUME_FAIL:
+			self.resume.setToken("")
+			self.OnResume(false)
+			return
+		case MSG_SEQ:
+			if inner := self.resume.unwrap(data); inner != nil {
+				self.dispatch(inner)
+			}
+			return
+		}
+	}
+	for _, filter := range self.filters.load() {
+		if data = filter.fn(data); data == nil {
+			return
+		}
+	}
+	self.OnData(data)
+}
+
+//添加收到的包的过滤器，返回nil表示包已处理，否则把返回的包交给下一个过滤器和 OnData
+func (self *TCPClient) addFilter(fn func(data []byte) []byte) func() {
+	return self.filters.add(0, fn)
+}
+
 //设置为重连状态
 func (self *TCPClient) reConnect() {
 	self.status = 2
 }
 
+//断开当前连接但不关闭客户端，读协程检测到断开后按心跳设置重连
+func (self *TCPClient) drop() {
+	if conn := self.conn; conn != nil {
+		conn.Close()
+	}
+}
+
 //手动关闭连接，手动关闭的不会重连
 func (self *TCPClient) Close() {
 	fmt.Printf("关闭 %p", self.conn)
@@ -88,57 +195,153 @@ func (self *TCPClient) Close() {
 func (self *TCPClient) Connect(addr *net.TCPAddr) error {
 	if addr != nil {
 		self.seraddr = addr
+		self.addrs = []string{addr.String()}
+		self.addrIdx = 0
+	}
+	return self.connect(addr != nil)
+}
+
+//连接多个服务器地址中的一个，失败时依次尝试下一个，断线重连同样按顺序切换
+//地址格式为 "host:port"，域名会在每次拨号时解析
+func (self *TCPClient) ConnectAddrs(addrs ...string) error {
+	if len(addrs) == 0 {
+		return nilConn
+	}
+	self.addrs = addrs
+	self.addrIdx = 0
+	return self.connect(true)
+}
+
+//设置拨号器，可以使用 SOCKS5Dialer、HTTPConnectDialer 走代理，
+//或用 DirectDialer 设置拨号超时和绑定本地地址，需在 Connect 之前调用
+func (self *TCPClient) SetDialer(dialer Dialer) {
+	if dialer == nil {
+		dialer = &DirectDialer{Timeout: DIAL_TIMEOUT}
+	}
+	self.dialer = dialer
+}
+
+//从上次成功的地址开始依次拨号，全部失败时返回最后一个错误
+func (self *TCPClient) dial() (net.Conn, error) {
+	if len(self.addrs) == 0 {
+		if self.seraddr == nil {
+			return nil, nilConn
+		}
+		self.addrs = []string{self.seraddr.String()}
+	}
+	var err error
+	for i := 0; i < len(self.addrs); i++ {
+		idx := (self.addrIdx + i) % len(self.addrs)
+		var con net.Conn
+		con, err = self.dialer.Dial("tcp", self.addrs[idx])
+		if err == nil {
+			self.addrIdx = idx
+			return con, nil
+		}
 	}
-	con, err := net.DialTCP("tcp", nil, self.seraddr)
+	return nil, err
+}
+
+//first 为首次连接，需要启动活动管理器
+func (self *TCPClient) connect(first bool) error {
+	con, err := self.dial()
 	if err != nil {
 		fmt.Println(err)
-		if addr != nil && self.status == 1 {
+		if first && self.status == 1 {
 			self.reConnect()
 			go self.aliveManager()
 		}
 		return err
 	} else {
-		if addr != nil && self.status == 1 {
+		if first && self.status == 1 {
 			go self.aliveManager()
 		}
 	}
-	con.SetNoDelay(false)
+	if tcpconn, ok := con.(*net.TCPConn); ok {
+		tcpconn.SetNoDelay(false)
+	}
 	self.isClosed = false
 	self.buf = bytes.NewBuffer(make([]byte, 0, JSON_CLIENT_BUF))
+	if self.protoType == PROTO_BYTE {
+		self.proto = NewByteProto(func(_ *Client, data []byte) { self.dispatch(data) }, nil, func(_ *Client, err error) {
+			self.OnError(err)
+			if err == TO_LAGER {
+				//半截包过大，数据流已无法对齐，断开后由读协程重连
+				con.Close()
+			}
+		})
+	}
 	self.conn = con
+	self.connSeq++
+	self.codec.Store(defaultCodec)
+	if self.protoType == PROTO_BYTE && len(self.versions) > 0 {
+		self.Write(helloPacket(self.versions, self.features))
+	}
+	//重连后凭令牌恢复会话
+	if packet := self.resume.resumePacket(); packet != nil && self.protoType == PROTO_BYTE {
+		self.Write(packet)
+	}
 	self.OnConnect()
 	go self.readData()
 	return nil
 }
 
-//设置事件回调
-func (self *TCPClient) On(key string, backfn interface{}) {
+//设置事件回调，再次调用会替换同一事件上次设置的回调，Events 中注册的其它监听器不受影响
+//事件名或函数签名不对时返回错误，需要多个监听器时使用编译期检查类型的 Events，例如 client.Events.Data.Add(fn)
+func (self *TCPClient) On(key string, backfn interface{}) error {
 	if backfn == nil {
-		return
+		return ErrEventFunc
 	}
-	switch strings.ToLower(key) {
+	key = strings.ToLower(key)
+	switch key {
 	case "connect":
-		if fn, ok := backfn.(func()); ok {
-			self.OnConnect = fn
+		fn, ok := backfn.(func())
+		if !ok {
+			return eventFuncError(key, backfn)
 		}
+		self.on.replace(key, self.Events.Connect.Add(fn))
 	case "close":
-		if fn, ok := backfn.(func()); ok {
-			self.OnClose = fn
+		fn, ok := backfn.(func())
+		if !ok {
+			return eventFuncError(key, backfn)
 		}
+		self.on.replace(key, self.Events.Close.Add(fn))
 	case "error":
-		if fn, ok := backfn.(func(err error)); ok {
-			self.OnError = fn
+		fn, ok := backfn.(func(err error))
+		if !ok {
+			return eventFuncError(key, backfn)
 		}
+		self.on.replace(key, self.Events.Error.Add(fn))
 	case "data":
-		if fn, ok := backfn.(func(data []byte)); ok {
-			self.OnData = fn
+		fn, ok := backfn.(func(data []byte))
+		if !ok {
+			return eventFuncError(key, backfn)
+		}
+		self.on.replace(key, self.Events.Data.Add(fn))
+	case "negotiate":
+		fn, ok := backfn.(func(codec *Codec))
+		if !ok {
+			return eventFuncError(key, backfn)
+		}
+		self.on.replace(key, self.Events.Negotiate.Add(fn))
+	case "resume":
+		fn, ok := backfn.(func(ok bool))
+		if !ok {
+			return eventFuncError(key, backfn)
 		}
+		self.on.replace(key, self.Events.Resume.Add(fn))
+	default:
+		return fmt.Errorf("%w: %s", ErrEventKey, key)
 	}
+	return nil
 }
 
 //写数据
 func (self *TCPClient) Write(data []byte) (n int, err error) {
 	if self.conn != nil {
+		if self.recorder != nil {
+			self.recorder.Record(self.connSeq, REC_OUT, data)
+		}
 		n, err = self.conn.Write(data)
 	} else {
 		return 0, nilConn
@@ -172,7 +375,11 @@ func (self *TCPClient) readData() {
 			}
 			break
 		}
-		self.PackageSplit(readbuf[:n])
+		if self.proto != nil {
+			self.proto.SplitPackage(nil, readbuf[:n])
+		} else {
+			self.PackageSplit(readbuf[:n])
+		}
 	}
 }
 
@@ -184,12 +391,12 @@ func (self *TCPClient) PackageSplit(buf []byte) {
 			if i > 0 && buf[i-1] == 13 {
 				//读取到包结束符号
 				self.buf.Write(buf[k : i-1])
-				self.OnData(self.buf.Bytes())
+				self.dispatch(self.buf.Bytes())
 				self.buf.Truncate(0)
 				k = i + 1
 			} else if i == 0 && self.buf.Len() > 0 && self.buf.Bytes()[self.buf.Len()-1] == 13 {
 				//读取到包结束符号
-				self.OnData(self.buf.Bytes()[:self.buf.Len()-1])
+				self.dispatch(self.buf.Bytes()[:self.buf.Len()-1])
 				self.buf.Truncate(0)
 				k = i + 1
 			}
@@ -5,69 +5,166 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//协议类型
+const (
+	PROTO_JSON = iota //\r\n 分隔的JSON协议
+	PROTO_BYTE        //PacketHead 包头协议
 )
 
 //服务器结构
 type TCPServer struct {
-	listener  *net.TCPListener
-	addr      *net.TCPAddr
-	OnStart   func(port int)
-	OnConnect func(conn *Client)
-	OnError   func(conn *Client, err error)
-	OnData    func(conn *Client, data []byte)
-	OnClose   func(conn *Client)
+	listener   *net.TCPListener
+	protoType  int             //客户端使用的协议类型
+	recorder   *Recorder       //会话记录器
+	versions   []byte          //支持的协议版本
+	features   uint32          //支持的特性
+	sessions   *SessionManager //会话恢复管理器
+	registry   *registry       //在线连接和房间
+	sniff      *sniffConfig    //单端口多协议嗅探，nil 不嗅探
+	graceful   *gracefulState  //平滑重启
+	addr       *net.TCPAddr
+	wsUpgrader *websocket.Upgrader //websocket升级器
+	wsMsgType  int                 //websocket写出的消息类型
+	Events     ServerEvents        //类型安全的事件，可注册多个监听器
+	on         onListeners         //On 注册的监听器
+	OnStart    func(port int)
+	OnConnect  func(conn *Client)
+	OnError    func(conn *Client, err error)
+	OnData     func(conn *Client, data []byte)
+	OnClose    func(conn *Client)
 }
 
 //创建服务器
 func NewTCPServer() (self *TCPServer) {
 	self = new(TCPServer)
-	self.OnStart = func(port int) {}
-	self.OnConnect = func(conn *Client) {}
-	self.OnError = func(conn *Client, err error) {}
-	self.OnData = func(conn *Client, data []byte) {}
-	self.OnClose = func(conn *Client) {}
+	self.versions = []byte{PROTO_VERSION_1}
+	self.registry = newRegistry()
+	self.graceful = newGracefulState()
+	self.wsUpgrader = &websocket.Upgrader{ReadBufferSize: WS_READ_BUF, WriteBufferSize: WS_WRITE_BUF}
+	self.wsMsgType = websocket.BinaryMessage
+	//默认把事件分发给 Events 中的监听器，直接给 OnXxx 赋值会替换掉这些监听器
+	self.OnStart = self.Events.Start.Emit
+	self.OnConnect = self.Events.Connect.Emit
+	self.OnError = self.Events.Error.Emit
+	self.OnData = self.Events.Data.Emit
+	self.OnClose = self.Events.Close.Emit
 	return
 }
 
-//设置事件监听
-func (self *TCPServer) On(key string, backfn interface{}) {
+//设置事件回调，再次调用会替换同一事件上次设置的回调，Events 中注册的其它监听器不受影响
+//事件名或函数签名不对时返回错误，需要多个监听器时使用编译期检查类型的 Events，例如 ser.Events.Data.Add(fn)
+func (self *TCPServer) On(key string, backfn interface{}) error {
 	if backfn == nil {
-		return
+		return ErrEventFunc
 	}
-	switch strings.ToLower(key) {
+	key = strings.ToLower(key)
+	switch key {
 	case "start":
-		if fn, ok := backfn.(func(port int)); ok {
-			self.OnStart = fn
+		fn, ok := backfn.(func(port int))
+		if !ok {
+			return eventFuncError(key, backfn)
 		}
+		self.on.replace(key, self.Events.Start.Add(fn))
 	case "connect":
-		if fn, ok := backfn.(func(conn *Client)); ok {
-			self.OnConnect = fn
+		fn, ok := backfn.(func(conn *Client))
+		if !ok {
+			return eventFuncError(key, backfn)
 		}
+		self.on.replace(key, self.Events.Connect.Add(fn))
 	case "error":
-		if fn, ok := backfn.(func(conn *Client, err error)); ok {
-			self.OnError = fn
+		fn, ok := backfn.(func(conn *Client, err error))
+		if !ok {
+			return eventFuncError(key, backfn)
 		}
+		self.on.replace(key, self.Events.Error.Add(fn))
 	case "data":
-		if fn, ok := backfn.(func(conn *Client, data []byte)); ok {
-			self.OnData = fn
+		fn, ok := backfn.(func(conn *Client, data []byte))
+		if !ok {
+			return eventFuncError(key, backfn)
 		}
+		self.on.replace(key, self.Events.Data.Add(fn))
 	case "close":
-		if fn, ok := backfn.(func(conn *Client)); ok {
-			self.OnClose = fn
+		fn, ok := backfn.(func(conn *Client))
+		if !ok {
+			return eventFuncError(key, backfn)
+		}
+		self.on.replace(key, self.Events.Close.Add(fn))
+	default:
+		return fmt.Errorf("%w: %s", ErrEventKey, key)
+	}
+	return nil
+}
+
+//设置客户端使用的协议，PROTO_JSON 或 PROTO_BYTE，默认 PROTO_JSON
+func (ser *TCPServer) SetProto(protoType int) {
+	ser.protoType = protoType
+}
+
+//客户端使用的协议
+func (ser *TCPServer) GetProto() int {
+	return ser.protoType
+}
+
+//设置会话记录器，记录之后建立的连接收发的数据，记录器需用 REC_SIDE_SERVER 创建，nil 关闭记录
+func (ser *TCPServer) SetRecorder(recorder *Recorder) {
+	ser.recorder = recorder
+}
+
+//设置支持的协议版本和特性，客户端握手时取双方共同支持的最高版本和特性，只对 PROTO_BYTE 有效
+//例如 SetFeatures([]byte{PROTO_VERSION_1, PROTO_VERSION_2}, FEATURE_COMPRESS|FEATURE_CHECKSUM)
+func (ser *TCPServer) SetFeatures(versions []byte, features uint32) {
+	ser.versions = versions
+	ser.features = features
+}
+
+//分发拆出的包，握手包和会话恢复包由服务器处理，不回调 OnData
+func (ser *TCPServer) dispatch(conn *Client, data []byte) {
+	conn.stats.in(len(data))
+	if ser.recorder != nil {
+		ser.recorder.Record(conn.id, REC_IN, data)
+	}
+	if ser.protoType == PROTO_BYTE {
+		switch data[HEAD_MSGTYPE_POS] {
+		case MSG_HELLO:
+			codec, err := negotiate(data, ser.versions, ser.features)
+			if err != nil {
+				ser.OnError(conn, err)
+				return
+			}
+			conn.setCodec(codec)
+			conn.Write(helloOkPacket(codec))
+			return
+		case MSG_RESUME:
+			if ser.sessions != nil {
+				ser.sessions.resume(conn, data)
+				return
+			}
 		}
 	}
+	ser.OnData(conn, data)
 }
 
+//开启监听，阻塞直到监听关闭，平滑重启时等待连接排空后返回
+//由 Restart 启动的新进程直接使用继承的监听，并接管移交过来的连接
 func (ser *TCPServer) Listen(addr *net.TCPAddr) bool {
-	listener, err := net.ListenTCP("tcp", addr)
+	listener, err := ser.listenTCP(addr)
 	if err != nil {
 		return false
 	}
-	ser.listener = listener
-	ser.addr = listener.Addr().(*net.TCPAddr)
+	ser.setListener(listener)
 	ser.OnStart(ser.addr.Port)
+	for _, conn := range takeInheritedConns() {
+		go ser.ServeConn(conn)
+	}
 	ser.loop()
+	ser.waitDrain()
 	return true
 }
 
@@ -82,15 +179,46 @@ func (ser *TCPServer) loop() {
 	for {
 		conn, err := ser.listener.AcceptTCP()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("accept err", err)
+			continue
+		}
+		go ser.serve(conn)
+	}
+}
+
+//在任意 net.Listener 上接受连接，例如 ListenKCP 返回的可靠UDP监听器，阻塞直到监听器关闭
+func (ser *TCPServer) ServeListener(listener net.Listener) bool {
+	port := 0
+	switch addr := listener.Addr().(type) {
+	case *net.TCPAddr:
+		port = addr.Port
+	case *net.UDPAddr:
+		port = addr.Port
+	}
+	ser.OnStart(port)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return true
+			}
 			fmt.Println("accept err", err)
 			continue
 		}
-		client := newClient(conn, ser)
-		ser.OnConnect(client)
-		go client.readLoop()
+		go ser.serve(conn)
 	}
 }
 
+//接管一个已建立的连接(TCP、websocket或内存连接)，阻塞直到连接的读循环结束
+func (ser *TCPServer) ServeConn(conn net.Conn) {
+	client := newClient(conn, ser, true)
+	ser.OnConnect(client)
+	client.serve(client.readDone())
+}
+
 //协议接口
 type Protocoler interface {
 	//读方法
@@ -99,72 +227,139 @@ type Protocoler interface {
 	SplitPackage(client *Client, readbuf []byte)
 }
 
+var clientSeq uint64 //连接ID生成器
+
 //客户端类
 type Client struct {
-	conn     *net.TCPConn           //连接对象
-	proto    Protocoler             //协议（数据读取和拆分和包装）
-	isClosed bool                   //是否调用关闭
-	attrs    map[string]interface{} //绑定属性
-	date     int64                  //连接时间
-	server   *TCPServer
+	id        uint64     //连接ID，进程内唯一
+	conn      net.Conn   //连接对象
+	proto     Protocoler //协议（数据读取和拆分和包装）
+	isClosed  int32      //是否调用关闭，原子操作
+	attrs     *Attrs     //绑定属性
+	date      int64      //连接时间
+	server    *TCPServer
+	closeHook func()              //关闭连接前的回调，用于从事件循环中移除
+	codec     atomic.Value        //协商后的编解码方式 *Codec
+	session   *Session            //可恢复的会话，未登录时为nil
+	sessLock  sync.Mutex          //保护 session
+	rooms     map[string]struct{} //加入的房间，由服务器的 registry 锁保护
+	stats     clientStats         //流量统计
+	done      chan struct{}       //每连接一个协程模式下读循环结束时关闭，epoll模式为nil，移交失败恢复读取时重新创建
+	doneLock  sync.Mutex          //保护 done
+	handoff   int32               //正在移交给新进程，读循环退出时不关闭连接
+	notified  int32               //是否已回调 OnClose/OnError，保证连接断开只回调一次
 }
 
 func (client *Client) readLoop() {
 	client.proto.Read(client)
 }
 
-//创建新客户端
-func newClient(conn *net.TCPConn, server *TCPServer) (client *Client) {
+//每连接一个协程模式的读循环，结束时关闭 done 通知等待移交的 detach
+func (client *Client) serve(done chan struct{}) {
+	defer close(done)
+	client.readLoop()
+}
+
+//创建新客户端，perConn 为true时由单独的协程读取，平滑重启时可以移交
+func newClient(conn net.Conn, server *TCPServer, perConn bool) (client *Client) {
 	client = new(Client)
-	conn.SetNoDelay(false)
+	if perConn {
+		client.done = make(chan struct{})
+	}
+	if tcpconn, ok := conn.(*net.TCPConn); ok {
+		tcpconn.SetNoDelay(false)
+	}
+	client.id = atomic.AddUint64(&clientSeq, 1)
 	client.conn = conn
 	client.server = server
-	//这里采用ByteProto
-	client.proto = NewJsonProto(server.OnData, server.OnClose, server.OnError)
-	client.attrs = make(map[string]interface{}, 2)
+	client.codec.Store(defaultCodec)
+	switch server.protoType {
+	case PROTO_BYTE:
+		client.proto = NewByteProto(server.dispatch, server.OnClose, server.OnError)
+	default:
+		client.proto = NewJsonProto(server.dispatch, server.OnClose, server.OnError)
+	}
+	client.attrs = NewAttrs()
 	client.date = time.Now().Unix()
+	server.registry.add(client)
 	return
 }
+
+//连接ID
+func (self *Client) Id() uint64 {
+	return self.id
+}
+
+//协商后的编解码方式，未协商时为版本1
+func (self *Client) Codec() *Codec {
+	return self.codec.Load().(*Codec)
+}
+func (self *Client) setCodec(codec *Codec) {
+	self.codec.Store(codec)
+	if proto, ok := self.proto.(*ByteProto); ok {
+		proto.SetCodec(codec)
+	}
+}
+
+//按协商结果封包并写出
+func (self *Client) WriteMsg(msgtype byte, targetid uint64, data []byte) (n int, err error) {
+	packet, err := self.Codec().Encode(msgtype, targetid, data)
+	if err != nil {
+		return 0, err
+	}
+	return self.Write(packet)
+}
+
+//可恢复的会话，需要服务器开启 EnableResume 并调用 Issue
+func (self *Client) Session() *Session {
+	self.sessLock.Lock()
+	defer self.sessLock.Unlock()
+	return self.session
+}
+func (self *Client) setSession(session *Session) {
+	self.sessLock.Lock()
+	self.session = session
+	self.sessLock.Unlock()
+}
+
+//连接的属性存储，可注册属性变化的回调
+func (self *Client) Attrs() *Attrs {
+	return self.attrs
+}
 func (self *Client) Set(key string, val interface{}) {
-	self.attrs[key] = val
+	self.attrs.Set(key, val)
+}
+
+//设置 ttl 后过期的属性，例如验证码、临时令牌
+func (self *Client) SetTTL(key string, val interface{}, ttl time.Duration) {
+	self.attrs.SetTTL(key, val, ttl)
 }
 func (self *Client) Get(key string) interface{} {
-	return self.attrs[key]
+	return self.attrs.Get(key)
+}
+func (self *Client) Lookup(key string) (interface{}, bool) {
+	return self.attrs.Lookup(key)
 }
+
+//以下按类型读取的方法在属性不存在或类型不符时返回零值，需要区分时使用 GetAs
 func (self *Client) GetString(key string) string {
-	v := self.attrs[key]
-	if str, ok := v.(string); ok {
-		return str
-	} else {
-		return ""
-	}
+	val, _ := GetAs[string](self.attrs, key)
+	return val
 }
 func (self *Client) GetInt(key string) int {
-	v := self.attrs[key]
-	if val, ok := v.(int); ok {
-		return val
-	} else {
-		return 0
-	}
+	val, _ := GetAs[int](self.attrs, key)
+	return val
 }
 func (self *Client) GetInt64(key string) int64 {
-	v := self.attrs[key]
-	if val, ok := v.(int64); ok {
-		return val
-	} else {
-		return 0
-	}
+	val, _ := GetAs[int64](self.attrs, key)
+	return val
 }
 func (self *Client) GetUint64(key string) uint64 {
-	v := self.attrs[key]
-	if val, ok := v.(uint64); ok {
-		return val
-	} else {
-		return 0
-	}
+	val, _ := GetAs[uint64](self.attrs, key)
+	return val
 }
 func (self *Client) Del(key string) {
-	delete(self.attrs, key)
+	self.attrs.Del(key)
 }
 func (self *Client) RemoteAddr() string {
 	return self.conn.RemoteAddr().String()
@@ -173,15 +368,51 @@ func (self *Client) IP() string {
 	arr := strings.Split(self.conn.RemoteAddr().String(), ":")
 	return arr[0]
 }
+
+//设置读超时，超时后读循环出错关闭连接，ListenEpoll 模式下不生效
 func (self *Client) SetTimeout(sec int32) {
 	self.conn.SetReadDeadline(time.Now().Add(time.Duration(sec) * time.Second))
 }
+
+//是否已调用 Close，读循环和管理协程都会检查
+func (self *Client) closed() bool {
+	return atomic.LoadInt32(&self.isClosed) == 1
+}
+
+//标记断开已回调，只有第一次调用返回true，返回true的调用方负责回调 OnClose/OnError
+func (self *Client) notifyClose() bool {
+	return atomic.CompareAndSwapInt32(&self.notified, 0, 1)
+}
+
+//服务端主动断开连接并回调 OnClose，读协程同时检测到断开时也只回调一次
+func (self *Client) Kick() {
+	self.Close()
+	if self.server != nil && self.notifyClose() {
+		self.server.OnClose(self)
+	}
+}
+
 func (self *Client) Close() {
-	self.isClosed = true
+	atomic.StoreInt32(&self.isClosed, 1)
+	if session := self.Session(); session != nil {
+		session.detach(self)
+	}
+	if self.server != nil {
+		self.server.registry.remove(self)
+	}
+	if self.closeHook != nil {
+		self.closeHook()
+	}
 	self.conn.Close()
 }
 func (self *Client) Write(data []byte) (n int, err error) {
+	if self.server != nil && self.server.recorder != nil {
+		self.server.recorder.Record(self.id, REC_OUT, data)
+	}
 	n, err = self.conn.Write(data)
+	if n > 0 {
+		self.stats.out(n)
+	}
 	return
 }
 
@@ -0,0 +1,107 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+//UDP客户端
+type UDPClient struct {
+	conn     *net.UDPConn
+	OnData   func(data []byte)
+	OnError  func(err error)
+	isClosed int32 //原子操作
+}
+
+func NewUDPClient() (self *UDPClient) {
+	self = new(UDPClient)
+	self.OnData = func(data []byte) {}
+	self.OnError = func(err error) {}
+	return
+}
+
+//设置事件回调，事件名或函数签名不对时返回错误，和 TCPClient.On 一致
+func (self *UDPClient) On(key string, backfn interface{}) error {
+	if backfn == nil {
+		return ErrEventFunc
+	}
+	key = strings.ToLower(key)
+	switch key {
+	case "error":
+		fn, ok := backfn.(func(err error))
+		if !ok {
+			return eventFuncError(key, backfn)
+		}
+		self.OnError = fn
+	case "data":
+		fn, ok := backfn.(func(data []byte))
+		if !ok {
+			return eventFuncError(key, backfn)
+		}
+		self.OnData = fn
+	default:
+		return fmt.Errorf("%w: %s", ErrEventKey, key)
+	}
+	return nil
+}
+
+//绑定服务器地址，UDP无连接，只是固定了发送目标
+func (self *UDPClient) Connect(addr *net.UDPAddr) error {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&self.isClosed, 0)
+	self.conn = conn
+	go self.readData()
+	return nil
+}
+
+//关闭
+func (self *UDPClient) Close() {
+	atomic.StoreInt32(&self.isClosed, 1)
+	if self.conn != nil {
+		self.conn.Close()
+	}
+}
+
+//发送原始数据报
+func (self *UDPClient) Write(data []byte) (n int, err error) {
+	if self.conn == nil {
+		return 0, nilConn
+	}
+	return self.conn.Write(data)
+}
+
+//以 WarpData 格式封包后发送
+func (self *UDPClient) WriteMsg(msgtype byte, data []byte) (n int, err error) {
+	packet := WarpData(msgtype, data)
+	if packet == nil {
+		return 0, TO_LAGER
+	}
+	return self.Write(packet)
+}
+
+//读取服务器回复的数据报
+func (self *UDPClient) readData() {
+	readbuf := make([]byte, UDP_RECV_BUF)
+	conn := self.conn
+	backoff := udpBackoff{}
+	for atomic.LoadInt32(&self.isClosed) == 0 {
+		n, err := conn.Read(readbuf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || atomic.LoadInt32(&self.isClosed) == 1 {
+				return
+			}
+			//对端未监听时会持续收到 connection refused
+			self.OnError(err)
+			backoff.wait()
+			continue
+		}
+		backoff.reset()
+		self.OnData(readbuf[:n])
+	}
+}
@@ -0,0 +1,253 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+)
+
+const (
+	UDP_RECV_BUF     = 64 * 1024            //单个数据报最大长度
+	UDP_PEER_TIMEOUT = 60                   //对端空闲多少秒后释放
+	UDP_ERR_BACKOFF  = 5 * time.Millisecond //读取出错后的初始等待时间，连续出错时翻倍
+	UDP_MAX_BACKOFF  = time.Second
+)
+
+//UDP服务器，每收到一个数据报回调一次OnData
+type UDPServer struct {
+	conn        *net.UDPConn
+	addr        *net.UDPAddr
+	peers       map[string]*UDPPeer //对端表，地址->对端
+	lock        *sync.Mutex
+	isClosed    int32 //原子操作
+	PeerTimeout int   //对端空闲超时时间(秒)，超时后绑定的属性会被释放
+	OnStart     func(port int)
+	OnData      func(peer *UDPPeer, data []byte)
+	OnError     func(peer *UDPPeer, err error)
+}
+
+//创建UDP服务器
+func NewUDPServer() (self *UDPServer) {
+	self = new(UDPServer)
+	self.peers = make(map[string]*UDPPeer)
+	self.lock = new(sync.Mutex)
+	self.PeerTimeout = UDP_PEER_TIMEOUT
+	self.OnStart = func(port int) {}
+	self.OnData = func(peer *UDPPeer, data []byte) {}
+	self.OnError = func(peer *UDPPeer, err error) {}
+	return
+}
+
+//设置事件回调，事件名或函数签名不对时返回错误，和 TCPServer.On 一致
+func (self *UDPServer) On(key string, backfn interface{}) error {
+	if backfn == nil {
+		return ErrEventFunc
+	}
+	key = strings.ToLower(key)
+	switch key {
+	case "start":
+		fn, ok := backfn.(func(port int))
+		if !ok {
+			return eventFuncError(key, backfn)
+		}
+		self.OnStart = fn
+	case "data":
+		fn, ok := backfn.(func(peer *UDPPeer, data []byte))
+		if !ok {
+			return eventFuncError(key, backfn)
+		}
+		self.OnData = fn
+	case "error":
+		fn, ok := backfn.(func(peer *UDPPeer, err error))
+		if !ok {
+			return eventFuncError(key, backfn)
+		}
+		self.OnError = fn
+	default:
+		return fmt.Errorf("%w: %s", ErrEventKey, key)
+	}
+	return nil
+}
+
+//开始监听，阻塞直到服务器关闭
+func (self *UDPServer) Listen(addr *net.UDPAddr) bool {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return false
+	}
+	self.conn = conn
+	self.addr = conn.LocalAddr().(*net.UDPAddr)
+	self.OnStart(self.addr.Port)
+	go self.cleaner()
+	self.loop()
+	return true
+}
+
+func (self *UDPServer) GetPort() (port int) {
+	if self.addr != nil {
+		port = self.addr.Port
+	}
+	return
+}
+
+//关闭服务器
+func (self *UDPServer) Close() {
+	atomic.StoreInt32(&self.isClosed, 1)
+	if self.conn != nil {
+		self.conn.Close()
+	}
+}
+
+//读取数据报，data 只在回调期间有效，需要保留请自行拷贝
+func (self *UDPServer) loop() {
+	readbuf := make([]byte, UDP_RECV_BUF)
+	backoff := udpBackoff{}
+	for !self.closed() {
+		n, addr, err := self.conn.ReadFromUDP(readbuf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || self.closed() {
+				return
+			}
+			logger.Debug("UDP读取异常:", err)
+			self.OnError(nil, err)
+			backoff.wait()
+			continue
+		}
+		backoff.reset()
+		peer := self.getPeer(addr)
+		self.OnData(peer, readbuf[:n])
+	}
+}
+
+func (self *UDPServer) closed() bool {
+	return atomic.LoadInt32(&self.isClosed) == 1
+}
+
+//连续读取出错时的退避，避免持续出错时空转
+type udpBackoff struct {
+	delay time.Duration
+}
+
+func (self *udpBackoff) wait() {
+	if self.delay == 0 {
+		self.delay = UDP_ERR_BACKOFF
+	} else if self.delay *= 2; self.delay > UDP_MAX_BACKOFF {
+		self.delay = UDP_MAX_BACKOFF
+	}
+	time.Sleep(self.delay)
+}
+
+func (self *udpBackoff) reset() {
+	self.delay = 0
+}
+
+//获取对端，不存在则创建
+func (self *UDPServer) getPeer(addr *net.UDPAddr) *UDPPeer {
+	key := addr.String()
+	now := time.Now().Unix()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	peer, ok := self.peers[key]
+	if !ok {
+		peer = newUDPPeer(addr, self)
+		self.peers[key] = peer
+	}
+	peer.active = now
+	return peer
+}
+
+//定时清理空闲的对端
+func (self *UDPServer) cleaner() {
+	if self.PeerTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(self.PeerTimeout) * time.Second)
+	defer ticker.Stop()
+	for !self.closed() {
+		<-ticker.C
+		deadline := time.Now().Unix() - int64(self.PeerTimeout)
+		self.lock.Lock()
+		for key, peer := range self.peers {
+			if peer.active < deadline {
+				delete(self.peers, key)
+			}
+		}
+		self.lock.Unlock()
+	}
+}
+
+//UDP对端，轻量的连接句柄，可以像 Client 一样绑定属性
+type UDPPeer struct {
+	addr   *net.UDPAddr
+	server *UDPServer
+	attrs  *Attrs //绑定属性
+	date   int64  //首次收到数据的时间
+	active int64  //最后收到数据的时间
+}
+
+func newUDPPeer(addr *net.UDPAddr, server *UDPServer) (peer *UDPPeer) {
+	peer = new(UDPPeer)
+	peer.addr = addr
+	peer.server = server
+	peer.attrs = NewAttrs()
+	peer.date = time.Now().Unix()
+	return
+}
+
+//绑定的属性，和 Client.Attrs 一样支持过期时间和变化回调
+func (self *UDPPeer) Attrs() *Attrs {
+	return self.attrs
+}
+func (self *UDPPeer) Set(key string, val interface{}) {
+	self.attrs.Set(key, val)
+}
+
+//设置 ttl 后过期的属性
+func (self *UDPPeer) SetTTL(key string, val interface{}, ttl time.Duration) {
+	self.attrs.SetTTL(key, val, ttl)
+}
+func (self *UDPPeer) Get(key string) interface{} {
+	return self.attrs.Get(key)
+}
+func (self *UDPPeer) Lookup(key string) (interface{}, bool) {
+	return self.attrs.Lookup(key)
+}
+func (self *UDPPeer) GetString(key string) string {
+	val, _ := GetAs[string](self.attrs, key)
+	return val
+}
+func (self *UDPPeer) GetInt(key string) int {
+	val, _ := GetAs[int](self.attrs, key)
+	return val
+}
+func (self *UDPPeer) GetInt64(key string) int64 {
+	val, _ := GetAs[int64](self.attrs, key)
+	return val
+}
+func (self *UDPPeer) GetUint64(key string) uint64 {
+	val, _ := GetAs[uint64](self.attrs, key)
+	return val
+}
+func (self *UDPPeer) Del(key string) {
+	self.attrs.Del(key)
+}
+func (self *UDPPeer) Addr() *net.UDPAddr {
+	return self.addr
+}
+func (self *UDPPeer) RemoteAddr() string {
+	return self.addr.String()
+}
+func (self *UDPPeer) IP() string {
+	return self.addr.IP.String()
+}
+
+//回复数据报
+func (self *UDPPeer) Write(data []byte) (n int, err error) {
+	return self.server.conn.WriteToUDP(data, self.addr)
+}
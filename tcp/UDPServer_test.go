@@ -0,0 +1,54 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPOnErrors(t *testing.T) {
+	ser := NewUDPServer()
+	if err := ser.On("data", func(peer *UDPPeer, data []byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ser.On("data", func(data []byte) {}); !errors.Is(err, ErrEventFunc) {
+		t.Fatalf("want ErrEventFunc, got %v", err)
+	}
+	if err := ser.On("close", func() {}); !errors.Is(err, ErrEventKey) {
+		t.Fatalf("want ErrEventKey, got %v", err)
+	}
+	client := NewUDPClient()
+	if err := client.On("data", func(data []byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.On("error", func() {}); !errors.Is(err, ErrEventFunc) {
+		t.Fatalf("want ErrEventFunc, got %v", err)
+	}
+	if err := client.On("start", func(port int) {}); !errors.Is(err, ErrEventKey) {
+		t.Fatalf("want ErrEventKey, got %v", err)
+	}
+}
+
+//对端属性和 Client 一样使用 Attrs
+func TestUDPPeerAttrs(t *testing.T) {
+	ser := NewUDPServer()
+	peer := ser.getPeer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	changed := make(chan string, 4)
+	peer.Attrs().AddHook(func(key string, old, val interface{}) { changed <- key })
+	peer.Set("uid", uint64(7))
+	peer.SetTTL("code", "1234", 10*time.Millisecond)
+	if peer.GetUint64("uid") != 7 || peer.GetString("code") != "1234" || peer.GetInt("uid") != 0 {
+		t.Fatal("attrs mismatch")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := peer.Lookup("code"); ok {
+		t.Fatal("code should have expired")
+	}
+	if ser.getPeer(peer.Addr()) != peer {
+		t.Fatal("peer not reused")
+	}
+	if len(changed) < 2 {
+		t.Fatalf("hooks fired %d times", len(changed))
+	}
+}
@@ -0,0 +1,128 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/donnie4w/go-logger/logger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	WS_READ_BUF  = 4 * 1024
+	WS_WRITE_BUF = 4 * 1024
+)
+
+//websocket连接适配成 net.Conn
+//消息边界会被忽略，收到的消息体按字节流交给 Protocoler 拆包，
+//所以浏览器端发送的数据要和TCP客户端一样带上分包格式（\r\n 或 PacketHead）
+type wsConn struct {
+	ws      *websocket.Conn
+	reader  io.Reader  //当前正在读取的消息
+	msgType int        //写出的消息类型
+	wlock   sync.Mutex //websocket不支持并发写
+}
+
+func newWSConn(ws *websocket.Conn, msgType int) *wsConn {
+	return &wsConn{ws: ws, msgType: msgType}
+}
+
+func (self *wsConn) Read(b []byte) (int, error) {
+	for {
+		if self.reader == nil {
+			_, reader, err := self.ws.NextReader()
+			if err != nil {
+				//正常关闭统一转为EOF，协议层据此回调OnClose
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			self.reader = reader
+		}
+		n, err := self.reader.Read(b)
+		if err == io.EOF {
+			//当前消息读完，继续读下一个消息
+			self.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (self *wsConn) Write(b []byte) (int, error) {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if err := self.ws.WriteMessage(self.msgType, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (self *wsConn) Close() error {
+	return self.ws.Close()
+}
+func (self *wsConn) LocalAddr() net.Addr {
+	return self.ws.LocalAddr()
+}
+func (self *wsConn) RemoteAddr() net.Addr {
+	return self.ws.RemoteAddr()
+}
+func (self *wsConn) SetDeadline(t time.Time) error {
+	if err := self.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return self.ws.SetWriteDeadline(t)
+}
+func (self *wsConn) SetReadDeadline(t time.Time) error {
+	return self.ws.SetReadDeadline(t)
+}
+func (self *wsConn) SetWriteDeadline(t time.Time) error {
+	return self.ws.SetWriteDeadline(t)
+}
+
+//设置websocket升级器，可配置跨域检测(CheckOrigin)、缓冲大小等，需在开始服务之前调用
+func (ser *TCPServer) SetWSUpgrader(upgrader *websocket.Upgrader) {
+	ser.wsUpgrader = upgrader
+}
+
+//设置websocket写出的消息类型，默认二进制消息，JSON协议可设置为 websocket.TextMessage，需在开始服务之前调用
+func (ser *TCPServer) SetWSMessageType(msgType int) {
+	ser.wsMsgType = msgType
+}
+
+//websocket接入的 http.Handler，升级后的连接和TCP连接一样产生 *Client 并触发同一组事件
+func (ser *TCPServer) ServeWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := ser.wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Debug(r.RemoteAddr, "websocket升级失败:", err)
+		return
+	}
+	ser.ServeConn(newWSConn(ws, ser.wsMsgType))
+}
+
+//开启websocket监听，path 为websocket的访问路径，例如 "/ws"
+//和 Listen 一样保存监听，GetPort 返回监听的端口，可以平滑重启，监听关闭后等待连接排空再返回
+func (ser *TCPServer) ListenWS(addr *net.TCPAddr, path string) bool {
+	listener, err := ser.listenTCP(addr)
+	if err != nil {
+		return false
+	}
+	ser.setListener(listener)
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, ser.ServeWS)
+	ser.OnStart(ser.addr.Port)
+	if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Error("websocket服务异常:", err)
+		return false
+	}
+	ser.waitDrain()
+	return true
+}
@@ -0,0 +1,45 @@
+package tcp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//ListenWS 保存监听和端口，关闭监听后返回
+func TestListenWS(t *testing.T) {
+	ser := NewTCPServer()
+	ser.SetProto(PROTO_BYTE)
+	ser.Events.Data.Add(func(conn *Client, data []byte) { conn.Write(data) })
+	started := make(chan int, 1)
+	ser.Events.Start.Add(func(port int) { started <- port })
+	returned := make(chan bool, 1)
+	go func() { returned <- ser.ListenWS(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, "/ws") }()
+	port := <-started
+	if port == 0 || ser.GetPort() != port || ser.getListener() == nil {
+		t.Fatalf("port %d, GetPort %d", port, ser.GetPort())
+	}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:"+strconv.Itoa(port)+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := WarpData(1, []byte("hello"))
+	ws.WriteMessage(websocket.BinaryMessage, frame)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, data, err := ws.ReadMessage(); err != nil || string(data) != string(frame) {
+		t.Fatal(data, err)
+	}
+	ws.Close()
+	ser.getListener().Close()
+	select {
+	case ok := <-returned:
+		if !ok {
+			t.Fatal("ListenWS returned false")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenWS did not return after the listener closed")
+	}
+}
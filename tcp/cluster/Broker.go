@@ -0,0 +1,155 @@
+package cluster
+
+import (
+	"sync"
+
+	"github.com/zdq007/go-common/util"
+)
+
+//集群使用的消息和存储服务，节点之间通过它转发数据并共享在线表
+type Broker interface {
+	Publish(channel string, data []byte) error
+	//订阅频道，handler 在后台协程中回调
+	Subscribe(channel string, handler func(data []byte))
+	HSet(key, field string, val []byte) error
+	HGet(key, field string) []byte
+	HDel(key, field string) error
+	//值等于 val 时删除，比较和删除必须是原子的，返回是否删除
+	HDelIf(key, field string, val []byte) (bool, error)
+	HGetAll(key string) map[string][]byte
+}
+
+//基于 RedisPool 的 Broker
+type RedisBroker struct {
+	pool *util.RedisPool
+}
+
+func NewRedisBroker(pool *util.RedisPool) *RedisBroker {
+	return &RedisBroker{pool: pool}
+}
+
+func (self *RedisBroker) Publish(channel string, data []byte) error {
+	return self.pool.PUBLISH(channel, data)
+}
+func (self *RedisBroker) Subscribe(channel string, handler func(data []byte)) {
+	self.pool.Subscribe(channel, handler)
+}
+func (self *RedisBroker) HSet(key, field string, val []byte) error {
+	return self.pool.HSET(key, field, val)
+}
+func (self *RedisBroker) HGet(key, field string) []byte {
+	return self.pool.HGET(key, field)
+}
+func (self *RedisBroker) HDel(key, field string) error {
+	return self.pool.HDEL(key, field)
+}
+func (self *RedisBroker) HDelIf(key, field string, val []byte) (bool, error) {
+	return self.pool.HDELIF(key, field, val)
+}
+func (self *RedisBroker) HGetAll(key string) map[string][]byte {
+	return self.pool.HGETALL(key)
+}
+
+//进程内的 Broker，用于单机多实例和测试，行为和 Redis 的 pub/sub、hash 一致
+type MemBroker struct {
+	hashes map[string]map[string][]byte
+	subs   map[string][]*memSub
+	lock   *sync.RWMutex
+}
+
+func NewMemBroker() *MemBroker {
+	return &MemBroker{
+		hashes: make(map[string]map[string][]byte),
+		subs:   make(map[string][]*memSub),
+		lock:   new(sync.RWMutex),
+	}
+}
+
+//一个订阅，消息先进入队列，由订阅自己的协程按发布顺序回调
+type memSub struct {
+	handler func(data []byte)
+	queue   [][]byte
+	lock    sync.Mutex
+	notify  chan struct{}
+}
+
+func (self *memSub) push(data []byte) {
+	self.lock.Lock()
+	self.queue = append(self.queue, data)
+	self.lock.Unlock()
+	select {
+	case self.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (self *memSub) loop() {
+	for range self.notify {
+		self.lock.Lock()
+		queue := self.queue
+		self.queue = nil
+		self.lock.Unlock()
+		for _, data := range queue {
+			self.handler(data)
+		}
+	}
+}
+
+//和 Redis 一样不等待订阅者处理，订阅者拿到的是数据的副本
+func (self *MemBroker) Publish(channel string, data []byte) error {
+	self.lock.RLock()
+	subs := self.subs[channel]
+	self.lock.RUnlock()
+	for _, sub := range subs {
+		sub.push(append([]byte(nil), data...))
+	}
+	return nil
+}
+func (self *MemBroker) Subscribe(channel string, handler func(data []byte)) {
+	sub := &memSub{handler: handler, notify: make(chan struct{}, 1)}
+	go sub.loop()
+	self.lock.Lock()
+	self.subs[channel] = append(self.subs[channel], sub)
+	self.lock.Unlock()
+}
+func (self *MemBroker) HSet(key, field string, val []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	hash := self.hashes[key]
+	if hash == nil {
+		hash = make(map[string][]byte)
+		self.hashes[key] = hash
+	}
+	hash[field] = append([]byte(nil), val...)
+	return nil
+}
+func (self *MemBroker) HGet(key, field string) []byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.hashes[key][field]
+}
+func (self *MemBroker) HDel(key, field string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.hashes[key], field)
+	return nil
+}
+func (self *MemBroker) HDelIf(key, field string, val []byte) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	cur, ok := self.hashes[key][field]
+	if !ok || string(cur) != string(val) {
+		return false, nil
+	}
+	delete(self.hashes[key], field)
+	return true, nil
+}
+func (self *MemBroker) HGetAll(key string) map[string][]byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	all := make(map[string][]byte, len(self.hashes[key]))
+	for field, val := range self.hashes[key] {
+		all[field] = val
+	}
+	return all
+}
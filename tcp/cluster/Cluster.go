@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zdq007/go-common/tcp"
+)
+
+const (
+	DEFAULT_PREFIX    = "tcpcluster"
+	HEARTBEAT         = 5 * time.Second  //节点心跳间隔
+	NODE_TIMEOUT      = 15 * time.Second //超过这个时间没有心跳的节点视为死亡
+	ROUTE_HEAD_LEN    = 8                //转发数据前的目标ID
+	presenceKeySuffix = ":presence"      //在线表 目标ID -> 节点ID
+	nodesKeySuffix    = ":nodes"         //节点表 节点ID -> 最后心跳时间(毫秒)
+	nodeChanSuffix    = ":node:"         //节点频道前缀
+)
+
+var (
+	ErrOffline = errors.New("target is offline")
+	ErrFrame   = errors.New("bad frame")
+)
+
+//网关集群，每个 TCPServer 实例作为一个节点
+//连接登录后调用 Bind 登记到在线表，发往不在本节点的目标经节点频道转发给持有连接的节点
+//各节点的时钟需要大致同步，心跳超时按节点写入的时间判断
+type Cluster struct {
+	nodeId      string
+	broker      Broker
+	local       map[uint64]*tcp.Client //本节点的连接
+	lock        *sync.RWMutex
+	stop        chan struct{}
+	Prefix      string                                //Redis key 和频道的前缀，需在 Start 之前设置
+	Heartbeat   time.Duration                         //心跳间隔，需在 Start 之前设置
+	NodeTimeout time.Duration                         //节点超时，需在 Start 之前设置
+	OnLost      func(targetid uint64, frame []byte)   //转发到本节点时目标已不在线
+	OnNodeDead  func(nodeId string, targets []uint64) //清理了死亡节点，targets 为它留下的在线记录
+}
+
+//创建集群节点，nodeId 在集群内唯一，例如 主机名:端口
+func New(nodeId string, broker Broker) *Cluster {
+	return &Cluster{
+		nodeId:      nodeId,
+		broker:      broker,
+		local:       make(map[uint64]*tcp.Client),
+		lock:        new(sync.RWMutex),
+		stop:        make(chan struct{}),
+		Prefix:      DEFAULT_PREFIX,
+		Heartbeat:   HEARTBEAT,
+		NodeTimeout: NODE_TIMEOUT,
+		OnLost:      func(targetid uint64, frame []byte) {},
+		OnNodeDead:  func(nodeId string, targets []uint64) {},
+	}
+}
+
+func (self *Cluster) NodeId() string {
+	return self.nodeId
+}
+
+func (self *Cluster) presenceKey() string {
+	return self.Prefix + presenceKeySuffix
+}
+func (self *Cluster) nodesKey() string {
+	return self.Prefix + nodesKeySuffix
+}
+func (self *Cluster) nodeChan(nodeId string) string {
+	return self.Prefix + nodeChanSuffix + nodeId
+}
+
+//订阅本节点的频道并开始心跳
+func (self *Cluster) Start() {
+	self.broker.Subscribe(self.nodeChan(self.nodeId), self.receive)
+	self.beat()
+	go self.heartbeat()
+}
+
+//停止心跳并清除本节点的在线记录
+func (self *Cluster) Stop() {
+	select {
+	case <-self.stop:
+		return
+	default:
+		close(self.stop)
+	}
+	self.lock.Lock()
+	targets := make([]uint64, 0, len(self.local))
+	for targetid := range self.local {
+		targets = append(targets, targetid)
+	}
+	self.local = make(map[uint64]*tcp.Client)
+	self.lock.Unlock()
+	for _, targetid := range targets {
+		self.unpublish(targetid)
+	}
+	self.broker.HDel(self.nodesKey(), self.nodeId)
+}
+
+//登记连接，之后发往 targetid 的数据都会路由到这个连接
+//连接关闭时需要调用 Unbind
+func (self *Cluster) Bind(targetid uint64, conn *tcp.Client) error {
+	self.lock.Lock()
+	self.local[targetid] = conn
+	self.lock.Unlock()
+	return self.broker.HSet(self.presenceKey(), strconv.FormatUint(targetid, 10), []byte(self.nodeId))
+}
+
+//注销连接，conn 不是当前登记的连接时忽略(例如已在其它连接上重新登录)
+func (self *Cluster) Unbind(targetid uint64, conn *tcp.Client) error {
+	self.lock.Lock()
+	if self.local[targetid] != conn {
+		self.lock.Unlock()
+		return nil
+	}
+	delete(self.local, targetid)
+	self.lock.Unlock()
+	return self.unpublish(targetid)
+}
+
+//在线表中的记录属于本节点时删除，目标可能已在其它节点登录
+func (self *Cluster) unpublish(targetid uint64) error {
+	_, err := self.broker.HDelIf(self.presenceKey(), strconv.FormatUint(targetid, 10), []byte(self.nodeId))
+	return err
+}
+
+//本节点上的连接
+func (self *Cluster) Local(targetid uint64) *tcp.Client {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.local[targetid]
+}
+
+//目标所在的节点，不在线时返回空
+func (self *Cluster) Locate(targetid uint64) string {
+	if self.Local(targetid) != nil {
+		return self.nodeId
+	}
+	return string(self.broker.HGet(self.presenceKey(), strconv.FormatUint(targetid, 10)))
+}
+
+//把完整的包发给目标连接，目标在其它节点时经该节点转发
+func (self *Cluster) Send(targetid uint64, frame []byte) error {
+	if conn := self.Local(targetid); conn != nil {
+		_, err := conn.Write(frame)
+		return err
+	}
+	nodeId := string(self.broker.HGet(self.presenceKey(), strconv.FormatUint(targetid, 10)))
+	if nodeId == "" || nodeId == self.nodeId {
+		return ErrOffline
+	}
+	data := make([]byte, ROUTE_HEAD_LEN, ROUTE_HEAD_LEN+len(frame))
+	binary.BigEndian.PutUint64(data, targetid)
+	return self.broker.Publish(self.nodeChan(nodeId), append(data, frame...))
+}
+
+//按包头的 Targetid 路由 PROTO_BYTE 的包，可在服务器的 OnData 中直接转发
+func (self *Cluster) Forward(frame []byte) error {
+	if uint32(len(frame)) < tcp.HEAD_LEN {
+		return ErrFrame
+	}
+	return self.Send(binary.BigEndian.Uint64(frame[tcp.HEAD_TARGETID_POS:]), frame)
+}
+
+//封包并发送给目标
+func (self *Cluster) SendMsg(msgtype byte, targetid uint64, data []byte) error {
+	frame, err := tcp.AppendFrame(make([]byte, 0, int(tcp.HEAD_LEN)+len(data)), tcp.PROTO_VERSION_1, msgtype, targetid, data)
+	if err != nil {
+		return err
+	}
+	return self.Send(targetid, frame)
+}
+
+//收到其它节点转发来的数据
+func (self *Cluster) receive(data []byte) {
+	select {
+	case <-self.stop:
+		return
+	default:
+	}
+	if len(data) < ROUTE_HEAD_LEN {
+		return
+	}
+	targetid := binary.BigEndian.Uint64(data)
+	frame := data[ROUTE_HEAD_LEN:]
+	conn := self.Local(targetid)
+	if conn == nil {
+		self.OnLost(targetid, frame)
+		return
+	}
+	conn.Write(frame)
+}
+
+//写入本节点的心跳时间
+//节点表中没有本节点时，说明心跳曾经超时(例如长时间停顿或与 Redis 断开)，本节点的在线记录已被其它节点清理，需要重新登记
+func (self *Cluster) beat() {
+	lost := self.broker.HGet(self.nodesKey(), self.nodeId) == nil
+	self.broker.HSet(self.nodesKey(), self.nodeId, []byte(strconv.FormatInt(time.Now().UnixMilli(), 10)))
+	if lost {
+		self.republish()
+	}
+}
+
+//重新登记本节点的所有连接，持有读锁保证不会恢复同时被 Unbind 的记录
+func (self *Cluster) republish() {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for targetid := range self.local {
+		self.broker.HSet(self.presenceKey(), strconv.FormatUint(targetid, 10), []byte(self.nodeId))
+	}
+}
+
+func (self *Cluster) heartbeat() {
+	ticker := time.NewTicker(self.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			self.beat()
+			self.cleanup()
+		}
+	}
+}
+
+//清理心跳超时的节点和它们留下的在线记录
+func (self *Cluster) cleanup() {
+	now := time.Now().UnixMilli()
+	dead := make(map[string][]uint64)
+	for nodeId, val := range self.broker.HGetAll(self.nodesKey()) {
+		if nodeId == self.nodeId {
+			continue
+		}
+		last, err := strconv.ParseInt(string(val), 10, 64)
+		if err != nil || now-last > self.NodeTimeout.Milliseconds() {
+			dead[nodeId] = nil
+		}
+	}
+	if len(dead) == 0 {
+		return
+	}
+	for field, val := range self.broker.HGetAll(self.presenceKey()) {
+		if targets, ok := dead[string(val)]; ok {
+			//目标可能刚在其它节点重新登录，只删除仍指向死亡节点的记录
+			if deleted, _ := self.broker.HDelIf(self.presenceKey(), field, val); deleted {
+				targetid, _ := strconv.ParseUint(field, 10, 64)
+				dead[string(val)] = append(targets, targetid)
+			}
+		}
+	}
+	for nodeId, targets := range dead {
+		self.broker.HDel(self.nodesKey(), nodeId)
+		self.OnNodeDead(nodeId, targets)
+	}
+}
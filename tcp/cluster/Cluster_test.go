@@ -0,0 +1,200 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zdq007/go-common/tcp"
+)
+
+func TestMemBrokerPublishAsync(t *testing.T) {
+	broker := NewMemBroker()
+	release := make(chan struct{})
+	got := make(chan byte, 16)
+	broker.Subscribe("ch", func(data []byte) {
+		<-release
+		got <- data[0]
+	})
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			broker.Publish("ch", []byte{byte(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked by a slow handler")
+	}
+	close(release)
+	for i := 0; i < 10; i++ {
+		select {
+		case b := <-got:
+			if b != byte(i) {
+				t.Fatalf("message %d out of order: %d", i, b)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestMemBrokerHDelIf(t *testing.T) {
+	broker := NewMemBroker()
+	broker.HSet("h", "f", []byte("a"))
+	if ok, _ := broker.HDelIf("h", "f", []byte("b")); ok {
+		t.Fatal("deleted with different value")
+	}
+	if ok, _ := broker.HDelIf("h", "f", []byte("a")); !ok {
+		t.Fatal("not deleted")
+	}
+	if broker.HGet("h", "f") != nil {
+		t.Fatal("field still exists")
+	}
+}
+
+//测试节点，连接通过内存管道接入，收到 msgtype 1 的包时按 Targetid 登记
+type testNode struct {
+	cluster *Cluster
+	server  *tcp.TCPServer
+	bound   chan uint64
+}
+
+func newTestNode(t *testing.T, nodeId string, broker Broker) *testNode {
+	node := &testNode{
+		cluster: New(nodeId, broker),
+		server:  tcp.NewTCPServer(),
+		bound:   make(chan uint64, 16),
+	}
+	node.cluster.Heartbeat = 20 * time.Millisecond
+	node.cluster.NodeTimeout = 100 * time.Millisecond
+	node.server.SetProto(tcp.PROTO_BYTE)
+	node.server.OnData = func(conn *tcp.Client, data []byte) {
+		head := tcp.NewPacketHead(data)
+		if head.Msgtype == 1 {
+			if err := node.cluster.Bind(head.Targetid, conn); err != nil {
+				t.Error(err)
+			}
+			node.bound <- head.Targetid
+			return
+		}
+		node.cluster.Forward(data)
+	}
+	node.cluster.Start()
+	t.Cleanup(node.cluster.Stop)
+	return node
+}
+
+//建立连接并以 targetid 登录
+func (self *testNode) login(t *testing.T, targetid uint64) net.Conn {
+	server, client := net.Pipe()
+	go self.server.ServeConn(server)
+	frame, _ := tcp.AppendFrame(nil, tcp.PROTO_VERSION_1, 1, targetid, nil)
+	go client.Write(frame)
+	select {
+	case <-self.bound:
+	case <-time.After(time.Second):
+		t.Fatal("login timeout")
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func readFrame(t *testing.T, conn net.Conn) []byte {
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestSendAcrossNodes(t *testing.T) {
+	broker := NewMemBroker()
+	n1 := newTestNode(t, "n1", broker)
+	n2 := newTestNode(t, "n2", broker)
+	n1.login(t, 100)
+	b := n2.login(t, 200)
+	if node := n1.cluster.Locate(200); node != "n2" {
+		t.Fatalf("locate 200: %q", node)
+	}
+	go n1.cluster.SendMsg(5, 200, []byte("hello"))
+	frame := readFrame(t, b)
+	if frame[tcp.HEAD_MSGTYPE_POS] != 5 || string(frame[tcp.HEAD_LEN:]) != "hello" {
+		t.Fatalf("frame %q", frame)
+	}
+	if err := n1.cluster.SendMsg(5, 300, nil); err != ErrOffline {
+		t.Fatalf("want ErrOffline, got %v", err)
+	}
+}
+
+//目标在另一个节点重新登录后，旧节点注销时不能删除新的在线记录
+func TestUnbindAfterRelogin(t *testing.T) {
+	broker := NewMemBroker()
+	n1 := newTestNode(t, "n1", broker)
+	n2 := newTestNode(t, "n2", broker)
+	n1.login(t, 100)
+	conn := n1.cluster.Local(100)
+	n2.login(t, 100)
+	if err := n1.cluster.Unbind(100, conn); err != nil {
+		t.Fatal(err)
+	}
+	if node := n1.cluster.Locate(100); node != "n2" {
+		t.Fatalf("locate 100: %q", node)
+	}
+}
+
+func TestDeadNodeCleanup(t *testing.T) {
+	broker := NewMemBroker()
+	n1 := newTestNode(t, "n1", broker)
+	dead := make(chan []uint64, 1)
+	n1.cluster.OnNodeDead = func(nodeId string, targets []uint64) {
+		if nodeId == "n2" {
+			dead <- targets
+		}
+	}
+	//n2 心跳停止，留下 200 的在线记录，201 在 n1 上在线，不能被清理
+	broker.HSet(n1.cluster.nodesKey(), "n2", []byte("1"))
+	broker.HSet(n1.cluster.presenceKey(), "200", []byte("n2"))
+	n1.login(t, 201)
+	select {
+	case targets := <-dead:
+		if len(targets) != 1 || targets[0] != 200 {
+			t.Fatalf("targets %v", targets)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead node not cleaned")
+	}
+	if node := n1.cluster.Locate(200); node != "" {
+		t.Fatalf("stale record for 200: %q", node)
+	}
+	if node := n1.cluster.Locate(201); node != "n1" {
+		t.Fatalf("locate 201: %q", node)
+	}
+}
+
+//本节点心跳超时被其它节点清理后，下一次心跳重新登记在线记录
+func TestRepublishAfterCleanup(t *testing.T) {
+	broker := NewMemBroker()
+	n1 := newTestNode(t, "n1", broker)
+	n1.login(t, 201)
+	n1.login(t, 202)
+	//模拟其它节点的 cleanup：先删除在线记录，再删除节点
+	broker.HDelIf(n1.cluster.presenceKey(), "201", []byte("n1"))
+	broker.HDelIf(n1.cluster.presenceKey(), "202", []byte("n1"))
+	broker.HDel(n1.cluster.nodesKey(), "n1")
+	deadline := time.Now().Add(time.Second)
+	presence := func(field string) string { return string(broker.HGet(n1.cluster.presenceKey(), field)) }
+	for presence("201") != "n1" || presence("202") != "n1" {
+		if time.Now().After(deadline) {
+			t.Fatal("presence not republished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if broker.HGet(n1.cluster.nodesKey(), "n1") == nil {
+		t.Fatal("node entry not restored")
+	}
+}
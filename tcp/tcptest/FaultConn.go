@@ -0,0 +1,119 @@
+//tcp 包的测试辅助，提供可注入故障的内存连接和挂载 TCPServer 的测试夹具
+package tcptest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+//模拟的连接重置错误
+var ErrReset = errors.New("connection reset by peer")
+
+//注入的故障，零值表示不注入任何故障
+type Faults struct {
+	Fragment       int           //每次读取最多返回的字节数，0不分片
+	RandomFragment bool          //在 1..Fragment 之间随机分片
+	SplitAt        []int         //在这些累计字节偏移处强制断开读取，必须递增
+	Latency        time.Duration //每次读取前的延迟
+	DropRate       float64       //每个字节被丢弃的概率
+	CorruptRate    float64       //每个字节被篡改的概率
+	ResetAfter     int           //累计读取多少字节后重置连接，0不重置
+	Seed           int64         //随机种子，相同种子可以复现同样的故障
+}
+
+//读取时注入故障的连接，写操作不受影响
+type FaultConn struct {
+	net.Conn
+	faults    Faults
+	rand      *rand.Rand
+	readCount int //已经从底层连接读取的字节数
+	lock      *sync.Mutex
+}
+
+func NewFaultConn(conn net.Conn, faults Faults) *FaultConn {
+	return &FaultConn{
+		Conn:   conn,
+		faults: faults,
+		rand:   rand.New(rand.NewSource(faults.Seed)),
+		lock:   new(sync.Mutex),
+	}
+}
+
+//已经从底层连接读取的字节数
+func (self *FaultConn) ReadCount() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.readCount
+}
+
+//只在更新计数和随机数时加锁，阻塞读取期间 ReadCount 仍可调用
+func (self *FaultConn) Read(b []byte) (n int, err error) {
+	for {
+		self.lock.Lock()
+		if self.faults.ResetAfter > 0 && self.readCount >= self.faults.ResetAfter {
+			self.lock.Unlock()
+			self.Conn.Close()
+			return 0, ErrReset
+		}
+		size := self.limit(len(b))
+		self.lock.Unlock()
+		if self.faults.Latency > 0 {
+			time.Sleep(self.faults.Latency)
+		}
+		n, err = self.Conn.Read(b[:size])
+		self.lock.Lock()
+		self.readCount += n
+		n = self.mangle(b[:n])
+		self.lock.Unlock()
+		//字节全部被丢弃时继续读取，避免返回0字节被当作连接关闭
+		if n > 0 || err != nil {
+			return
+		}
+	}
+}
+
+//计算本次读取的最大字节数，需持有锁
+func (self *FaultConn) limit(size int) int {
+	if frag := self.faults.Fragment; frag > 0 {
+		if self.faults.RandomFragment {
+			frag = 1 + self.rand.Intn(frag)
+		}
+		if frag < size {
+			size = frag
+		}
+	}
+	for _, pos := range self.faults.SplitAt {
+		if pos > self.readCount {
+			if pos-self.readCount < size {
+				size = pos - self.readCount
+			}
+			break
+		}
+	}
+	if self.faults.ResetAfter > 0 && self.faults.ResetAfter-self.readCount < size {
+		size = self.faults.ResetAfter - self.readCount
+	}
+	return size
+}
+
+//丢弃和篡改字节，返回处理后的长度，需持有锁
+func (self *FaultConn) mangle(b []byte) int {
+	if self.faults.DropRate <= 0 && self.faults.CorruptRate <= 0 {
+		return len(b)
+	}
+	n := 0
+	for _, c := range b {
+		if self.faults.DropRate > 0 && self.rand.Float64() < self.faults.DropRate {
+			continue
+		}
+		if self.faults.CorruptRate > 0 && self.rand.Float64() < self.faults.CorruptRate {
+			c ^= byte(1 + self.rand.Intn(255))
+		}
+		b[n] = c
+		n++
+	}
+	return n
+}
@@ -0,0 +1,81 @@
+package tcptest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zdq007/go-common/tcp"
+)
+
+//包结束符 \r\n 被拆到两次读取中
+func TestJsonSplitLineEnd(t *testing.T) {
+	data := []byte("abc\r\ndef\r\n")
+	for _, split := range []int{4, 9} {
+		h := NewHarness(tcp.PROTO_JSON)
+		conn := h.Dial(Faults{SplitAt: []int{split}})
+		go conn.Write(data)
+		h.AssertFrames(t, time.Second, []byte("abc"), []byte("def"))
+		conn.Close()
+	}
+}
+
+//12字节的包头被拆到多次读取中
+func TestBytePartialHead(t *testing.T) {
+	first := tcp.WarpData(1, []byte("hello"))
+	second := tcp.WarpData(2, []byte("world"))
+	data := append(append([]byte(nil), first...), second...)
+	for _, split := range [][]int{{1}, {5, 11}, {len(first) + 3}, {len(first) + 11}} {
+		h := NewHarness(tcp.PROTO_BYTE)
+		conn := h.Dial(Faults{SplitAt: split})
+		go conn.Write(data)
+		h.AssertFrames(t, time.Second, first, second)
+		conn.Close()
+	}
+}
+
+func TestByteFragment(t *testing.T) {
+	var data []byte
+	var want [][]byte
+	for i := 0; i < 10; i++ {
+		frame := tcp.WarpData(byte(i), make([]byte, i*31))
+		want = append(want, frame)
+		data = append(data, frame...)
+	}
+	for frag := 1; frag < 20; frag += 3 {
+		h := NewHarness(tcp.PROTO_BYTE)
+		conn := h.Dial(Faults{Fragment: frag, RandomFragment: true, Seed: int64(frag)})
+		go conn.Write(data)
+		h.AssertFrames(t, time.Second, want...)
+		conn.Close()
+	}
+}
+
+func TestResetAfter(t *testing.T) {
+	h := NewHarness(tcp.PROTO_BYTE)
+	conn := h.Dial(Faults{ResetAfter: 20})
+	go conn.Write(tcp.WarpData(1, make([]byte, 100)))
+	if err := h.WaitError(time.Second); err != ErrReset {
+		t.Fatalf("want ErrReset, got %v", err)
+	}
+}
+
+//阻塞在读取时 ReadCount 不能被锁住
+func TestReadCountWhileReading(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewFaultConn(server, Faults{})
+	go conn.Read(make([]byte, 16))
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan int, 1)
+	go func() { done <- conn.ReadCount() }()
+	select {
+	case n := <-done:
+		if n != 0 {
+			t.Fatalf("read count %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadCount blocked by Read")
+	}
+	conn.Close()
+}
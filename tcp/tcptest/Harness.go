@@ -0,0 +1,106 @@
+package tcptest
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zdq007/go-common/tcp"
+)
+
+var ErrTimeout = errors.New("wait frames timeout")
+
+//测试夹具，在内存连接上运行 TCPServer，收集 OnData 收到的包
+type Harness struct {
+	Server *tcp.TCPServer
+	frames chan []byte
+	errs   chan error
+	closes chan *tcp.Client
+}
+
+//创建夹具，protoType 为服务器使用的协议
+func NewHarness(protoType int) *Harness {
+	h := &Harness{
+		Server: tcp.NewTCPServer(),
+		frames: make(chan []byte, 1024),
+		errs:   make(chan error, 16),
+		closes: make(chan *tcp.Client, 16),
+	}
+	h.Server.SetProto(protoType)
+	//通过 Events 监听，测试中还可以在 Server.Events 上注册自己的监听器
+	h.Server.Events.Data.Add(func(conn *tcp.Client, data []byte) {
+		//data 只在回调期间有效，需要拷贝
+		h.frames <- append([]byte(nil), data...)
+	})
+	h.Server.Events.Error.Add(func(conn *tcp.Client, err error) {
+		h.errs <- err
+	})
+	h.Server.Events.Close.Add(func(conn *tcp.Client) {
+		h.closes <- conn
+	})
+	return h
+}
+
+//建立一个连接到服务器的内存连接，服务器读取时注入 faults 中的故障，返回客户端一端
+//服务器回写的数据需要客户端读取，否则服务器的写操作会阻塞
+func (self *Harness) Dial(faults Faults) net.Conn {
+	server, client := net.Pipe()
+	go self.Server.ServeConn(NewFaultConn(server, faults))
+	return client
+}
+
+//等待收到 n 个包
+func (self *Harness) Frames(n int, timeout time.Duration) ([][]byte, error) {
+	frames := make([][]byte, 0, n)
+	deadline := time.After(timeout)
+	for len(frames) < n {
+		select {
+		case frame := <-self.frames:
+			frames = append(frames, frame)
+		case <-deadline:
+			return frames, ErrTimeout
+		}
+	}
+	return frames, nil
+}
+
+//等待服务器回调 OnError
+func (self *Harness) WaitError(timeout time.Duration) error {
+	select {
+	case err := <-self.errs:
+		return err
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+//等待服务器回调 OnClose
+func (self *Harness) WaitClose(timeout time.Duration) error {
+	select {
+	case <-self.closes:
+		return nil
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+//断言 OnData 按顺序收到了 want 中的包，并且没有多余的包
+func (self *Harness) AssertFrames(t testing.TB, timeout time.Duration, want ...[]byte) {
+	t.Helper()
+	got, err := self.Frames(len(want), timeout)
+	if err != nil {
+		t.Fatalf("expect %d frames, got %d: %v", len(want), len(got), err)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("frame %d: expect %q, got %q", i, want[i], got[i])
+		}
+	}
+	select {
+	case extra := <-self.frames:
+		t.Fatalf("unexpected frame %q", extra)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -1,16 +1,21 @@
 package test
 
 import (
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Test struct {
-	count int64
+	count     int64
+	latencies []time.Duration //记录的延迟
+	lock      *sync.Mutex
 }
 func NewTest() *Test{
 	return &Test{
 		count:0,
+		lock:new(sync.Mutex),
 	}
 }
 func (self *Test) timer(ms int, fun func(count int64)) {
@@ -36,3 +41,67 @@ func (self *Test) Counter(ms int, fun func(count int64)) {
 		self.timer(ms, fun)
 	}()
 }
+
+//延迟统计结果
+type Stat struct {
+	Count int64
+	Min   time.Duration
+	Max   time.Duration
+	Avg   time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+}
+
+//记录一次请求的延迟，同时计数
+func (self *Test) AddLatency(d time.Duration) {
+	self.Add()
+	self.lock.Lock()
+	self.latencies = append(self.latencies, d)
+	self.lock.Unlock()
+}
+
+//累计记录的延迟个数
+func (self *Test) Total() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return int64(len(self.latencies))
+}
+
+//统计延迟分布
+func (self *Test) Stat() Stat {
+	self.lock.Lock()
+	sorted := make([]time.Duration, len(self.latencies))
+	copy(sorted, self.latencies)
+	self.lock.Unlock()
+	stat := Stat{Count: int64(len(sorted))}
+	if len(sorted) == 0 {
+		return stat
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	stat.Min = sorted[0]
+	stat.Max = sorted[len(sorted)-1]
+	stat.Avg = sum / time.Duration(len(sorted))
+	stat.P50 = percentile(sorted, 0.50)
+	stat.P90 = percentile(sorted, 0.90)
+	stat.P99 = percentile(sorted, 0.99)
+	stat.P999 = percentile(sorted, 0.999)
+	return stat
+}
+
+//已排序延迟的百分位
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
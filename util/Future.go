@@ -0,0 +1,187 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//任务执行中 panic 时 Future 返回的错误
+var ErrJobPanic = errors.New("job panic")
+
+//任务结果，任务执行完成后 Done 关闭
+type Future struct {
+	done   chan struct{}
+	once   sync.Once
+	result interface{}
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+//执行任务并记录结果，panic 转为 ErrJobPanic 错误，不影响工人协程
+func (self *Future) run(fn func() (interface{}, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			self.complete(nil, fmt.Errorf("%w: %v", ErrJobPanic, r))
+		}
+	}()
+	self.complete(fn())
+}
+
+//只有第一次完成有效，超时放弃的任务稍后返回时忽略其结果
+func (self *Future) complete(result interface{}, err error) {
+	self.once.Do(func() {
+		self.result = result
+		self.err = err
+		close(self.done)
+	})
+}
+
+//是否已完成，不阻塞
+func (self *Future) finished() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//任务完成时关闭
+func (self *Future) Done() <-chan struct{} {
+	return self.done
+}
+
+//等待任务完成，ctx 先结束时返回 ctx.Err()，任务不受影响
+func (self *Future) Wait(ctx context.Context) (interface{}, error) {
+	select {
+	case <-self.done:
+		return self.result, self.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//任务的返回值，阻塞直到任务完成
+func (self *Future) Result() interface{} {
+	<-self.done
+	return self.result
+}
+
+//任务的错误，阻塞直到任务完成
+func (self *Future) Err() error {
+	<-self.done
+	return self.err
+}
+
+//提交有返回值的任务，level 同 AddJob
+func (self *WorkPool) Submit(level byte, fn func() (interface{}, error)) *Future {
+	future := newFuture()
+	job := NewJob(func(...interface{}) { future.run(fn) })
+	job.future = future
+	self.addJob(level, job)
+	return future
+}
+
+//提交接收 context 的任务，ctx 取消、超过 timeout 或工作池 Stop 时任务返回 ctx 的错误
+//开始前已取消的任务不会执行，timeout<=0 不限时
+func (self *WorkPool) SubmitCtx(ctx context.Context, level byte, timeout time.Duration, fn func(ctx context.Context) (interface{}, error)) *Future {
+	future := newFuture()
+	self.addJob(level, &Job{
+		ctx:     ctx,
+		timeout: timeout,
+		ctxfun: func(ctx context.Context) {
+			future.run(func() (interface{}, error) { return fn(ctx) })
+		},
+		future: future,
+	})
+	return future
+}
+
+//类型化的任务结果
+type TypedFuture[T any] struct {
+	future *Future
+}
+
+//提交返回 T 类型结果的任务，例如
+//
+//	f := util.SubmitTyped(pool, 1, func() (int, error) { return 42, nil })
+//	n, err := f.Wait(ctx)
+func SubmitTyped[T any](pool *WorkPool, level byte, fn func() (T, error)) *TypedFuture[T] {
+	return &TypedFuture[T]{future: pool.Submit(level, func() (interface{}, error) { return fn() })}
+}
+
+//SubmitCtx 的类型化版本
+func SubmitTypedCtx[T any](pool *WorkPool, ctx context.Context, level byte, timeout time.Duration, fn func(ctx context.Context) (T, error)) *TypedFuture[T] {
+	return &TypedFuture[T]{future: pool.SubmitCtx(ctx, level, timeout, func(ctx context.Context) (interface{}, error) { return fn(ctx) })}
+}
+
+func (self *TypedFuture[T]) Done() <-chan struct{} {
+	return self.future.Done()
+}
+
+func (self *TypedFuture[T]) Wait(ctx context.Context) (T, error) {
+	result, err := self.future.Wait(ctx)
+	val, _ := result.(T)
+	return val, err
+}
+
+func (self *TypedFuture[T]) Result() T {
+	val, _ := self.future.Result().(T)
+	return val
+}
+
+func (self *TypedFuture[T]) Err() error {
+	return self.future.Err()
+}
+
+//无类型的结果
+func (self *TypedFuture[T]) Future() *Future {
+	return self.future
+}
+
+//可等待的任务结果，*Future 和 *TypedFuture 都实现了这个接口
+type Awaitable interface {
+	Done() <-chan struct{}
+	Err() error
+}
+
+//等待所有任务完成，返回所有任务错误的合并，ctx 先结束时返回 ctx.Err()
+func WaitAll(ctx context.Context, futures ...Awaitable) error {
+	var errs []error
+	for _, future := range futures {
+		select {
+		case <-future.Done():
+			if err := future.Err(); err != nil {
+				errs = append(errs, err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//等待任意一个任务完成，返回它的下标和错误，ctx 先结束时下标为-1
+//用 reflect.Select 同时等待所有 Done 通道，不为每个任务额外启动协程
+func WaitAny(ctx context.Context, futures ...Awaitable) (int, error) {
+	if len(futures) == 0 {
+		return -1, nil
+	}
+	cases := make([]reflect.SelectCase, len(futures)+1)
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+	for i, future := range futures {
+		cases[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(future.Done())}
+	}
+	chosen, _, _ := reflect.Select(cases)
+	if chosen == 0 {
+		return -1, ctx.Err()
+	}
+	return chosen - 1, futures[chosen-1].Err()
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T) *WorkPool {
+	pool := NewLevelWorkPool(16, 4)
+	pool.Run()
+	t.Cleanup(pool.Stop)
+	return pool
+}
+
+func TestSubmit(t *testing.T) {
+	pool := newTestPool(t)
+	future := pool.Submit(1, func() (interface{}, error) { return 7, nil })
+	if val, err := future.Wait(context.Background()); val != 7 || err != nil {
+		t.Fatal(val, err)
+	}
+	failed := pool.Submit(1, func() (interface{}, error) { return nil, errors.New("bad") })
+	if err := failed.Err(); err == nil || err.Error() != "bad" {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmitTyped(t *testing.T) {
+	pool := newTestPool(t)
+	future := SubmitTyped(pool, 2, func() (string, error) { return "ok", nil })
+	if val, err := future.Wait(context.Background()); val != "ok" || err != nil {
+		t.Fatal(val, err)
+	}
+	if future.Result() != "ok" || future.Future().Result() != "ok" {
+		t.Fatal("result mismatch")
+	}
+	ctxFuture := SubmitTypedCtx(pool, context.Background(), 1, 20*time.Millisecond, func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	if _, err := ctxFuture.Wait(context.Background()); err != context.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+}
+
+//任务 panic 时返回 ErrJobPanic，工人协程继续执行后面的任务
+func TestSubmitPanic(t *testing.T) {
+	pool := NewWorkPool(4, 1)
+	pool.Run()
+	defer pool.Stop()
+	future := SubmitTyped(pool, 1, func() (int, error) { panic("boom") })
+	if err := future.Err(); !errors.Is(err, ErrJobPanic) {
+		t.Fatalf("want ErrJobPanic, got %v", err)
+	}
+	if val := SubmitTyped(pool, 1, func() (int, error) { return 9, nil }).Result(); val != 9 {
+		t.Fatal(val)
+	}
+}
+
+func TestWaitAll(t *testing.T) {
+	pool := newTestPool(t)
+	slow := SubmitTyped(pool, 1, func() (int, error) {
+		time.Sleep(20 * time.Millisecond)
+		return 1, nil
+	})
+	bad := SubmitTyped(pool, 1, func() (int, error) { return 0, errors.New("bad") })
+	boom := SubmitTyped(pool, 1, func() (int, error) { panic("boom") })
+	err := WaitAll(context.Background(), slow, bad, boom)
+	if !errors.Is(err, ErrJobPanic) || slow.Result() != 1 {
+		t.Fatal(err)
+	}
+	if err := WaitAll(context.Background(), slow); err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	defer close(block)
+	pending := pool.Submit(1, func() (interface{}, error) {
+		<-block
+		return nil, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := WaitAll(ctx, slow, pending); err != context.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestWaitAny(t *testing.T) {
+	pool := newTestPool(t)
+	block := make(chan struct{})
+	defer close(block)
+	slow := SubmitTyped(pool, 1, func() (int, error) {
+		<-block
+		return 1, nil
+	})
+	fast := SubmitTyped(pool, 1, func() (int, error) { return 2, errors.New("fast") })
+	if i, err := WaitAny(context.Background(), slow, fast); i != 1 || err == nil || err.Error() != "fast" {
+		t.Fatal(i, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if i, err := WaitAny(ctx, slow); i != -1 || err != context.DeadlineExceeded {
+		t.Fatal(i, err)
+	}
+	if i, err := WaitAny(context.Background()); i != -1 || err != nil {
+		t.Fatal(i, err)
+	}
+}
+
+//等待大量任务时不为每个任务启动协程
+func TestWaitAnyNoGoroutines(t *testing.T) {
+	futures := make([]Awaitable, 1000)
+	for i := range futures {
+		futures[i] = newFuture()
+	}
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan int, 1)
+	go func() {
+		i, _ := WaitAny(ctx, futures...)
+		result <- i
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if n := runtime.NumGoroutine() - before; n > 1 {
+		t.Fatalf("WaitAny started %d goroutines", n)
+	}
+	futures[500].(*Future).complete(nil, nil)
+	if i := <-result; i != 500 {
+		t.Fatal(i)
+	}
+	cancel()
+}
@@ -148,10 +148,21 @@ func (self *RedisPool) DEL(keys ...interface{}) {
 }
 
 //hset 删除
-func (self *RedisPool) HDEL(key string, filed interface{}) {
+func (self *RedisPool) HDEL(key string, filed interface{}) error {
 	c := self.Pool.Get()
 	defer c.Close()
-	c.Send("HDEL", key, filed)
+	_, err := c.Do("HDEL", key, filed)
+	return err
+}
+
+//值等于 val 时删除，比较和删除在 Redis 中原子执行
+var hdelIfScript = redis.NewScript(1, `if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then return redis.call("HDEL", KEYS[1], ARGV[1]) end return 0`)
+
+//hset 比较后删除，返回是否删除
+func (self *RedisPool) HDELIF(key string, filed, val interface{}) (bool, error) {
+	c := self.Pool.Get()
+	defer c.Close()
+	return redis.Bool(hdelIfScript.Do(c, key, filed, val))
 }
 
 //设置超时 dtime 秒
@@ -238,10 +249,11 @@ func (self *RedisPool) Subscribe(chanl string, handel func(data []byte)) {
 }
 
 //发布
-func (self *RedisPool) PUBLISH(chanl string, value interface{}) {
+func (self *RedisPool) PUBLISH(chanl string, value interface{}) error {
 	c := self.Pool.Get()
 	defer c.Close()
-	c.Send("PUBLISH", chanl, value)
+	_, err := c.Do("PUBLISH", chanl, value)
+	return err
 }
 
 func redisServer(c redis.Conn) {
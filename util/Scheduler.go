@@ -0,0 +1,181 @@
+package util
+
+import (
+	"errors"
+	"sync"
+)
+
+//调度方式
+const (
+	SCHED_STRICT   = iota //严格优先级，高优先级队列有任务时低优先级不执行
+	SCHED_WEIGHTED        //按权重分配执行机会，低优先级连续被跳过 SCHED_MAX_SKIP 次后优先执行一次
+)
+
+const (
+	SCHED_MAX_SKIP   = 64  //加权调度时，有任务的队列最多被连续跳过的次数
+	SCHED_MAX_LEVELS = 255 //级别用 byte 表示，最多255级
+)
+
+var ErrPoolClosed = errors.New("work pool closed")
+
+//多级任务队列，level 从1开始，1 最优先
+type scheduler struct {
+	mode     int
+	queues   [][]*Job
+	capacity int   //每级队列的容量，满了之后添加任务阻塞，0 时添加任务阻塞到被工人取走
+	weights  []int //各级权重
+	current  []int //平滑加权轮询的当前值
+	skipped  []int //有任务但未被选中的连续次数
+	maxSkip  int
+	size     int
+	closed   bool
+	draining bool //不再接受任务，排队中的任务取完后关闭
+	lock     *sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+}
+
+func newScheduler(mode int, weights []int, capacity int) *scheduler {
+	levels := len(weights)
+	sched := &scheduler{
+		mode:     mode,
+		queues:   make([][]*Job, levels),
+		capacity: capacity,
+		weights:  weights,
+		current:  make([]int, levels),
+		skipped:  make([]int, levels),
+		maxSkip:  SCHED_MAX_SKIP,
+		lock:     new(sync.Mutex),
+	}
+	sched.notEmpty = sync.NewCond(sched.lock)
+	sched.notFull = sync.NewCond(sched.lock)
+	return sched
+}
+
+//级别超出范围时放入最低优先级
+func (self *scheduler) index(level byte) int {
+	if level < 1 || int(level) > len(self.queues) {
+		return len(self.queues) - 1
+	}
+	return int(level) - 1
+}
+
+//加入队列，队列满时阻塞，已关闭或正在排空时返回false
+//容量为0时和无缓冲通道一样，阻塞到任务被工人取走或队列关闭，关闭时任务由 close 返回
+func (self *scheduler) push(level byte, job *Job) bool {
+	i := self.index(level)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for !self.closed && !self.draining && self.capacity > 0 && len(self.queues[i]) >= self.capacity {
+		self.notFull.Wait()
+	}
+	if self.closed || self.draining {
+		return false
+	}
+	self.queues[i] = append(self.queues[i], job)
+	self.size++
+	job.queued = true
+	self.notEmpty.Signal()
+	for self.capacity == 0 && job.queued {
+		self.notFull.Wait()
+	}
+	return true
+}
+
+//取出下一个任务，队列为空时阻塞，关闭后或排空后返回false
+func (self *scheduler) pop() (*Job, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for !self.closed && !self.draining && self.size == 0 {
+		self.notEmpty.Wait()
+	}
+	if self.closed || self.size == 0 {
+		return nil, false
+	}
+	i := self.pick()
+	job := self.queues[i][0]
+	job.queued = false
+	self.queues[i][0] = nil
+	self.queues[i] = self.queues[i][1:]
+	self.size--
+	self.notFull.Broadcast()
+	return job, true
+}
+
+//选出要执行的队列，需持有锁且至少有一个任务
+func (self *scheduler) pick() int {
+	if self.mode == SCHED_STRICT {
+		for i, queue := range self.queues {
+			if len(queue) > 0 {
+				return i
+			}
+		}
+	}
+	//被跳过太久的队列优先，防止低权重队列饿死
+	for i, queue := range self.queues {
+		if len(queue) > 0 && self.skipped[i] >= self.maxSkip {
+			self.picked(i)
+			return i
+		}
+	}
+	//平滑加权轮询，只在有任务的队列间分配
+	best, total := -1, 0
+	for i, queue := range self.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		self.current[i] += self.weights[i]
+		total += self.weights[i]
+		if best < 0 || self.current[i] > self.current[best] {
+			best = i
+		}
+	}
+	self.current[best] -= total
+	self.picked(best)
+	return best
+}
+
+func (self *scheduler) picked(best int) {
+	for i, queue := range self.queues {
+		if i == best {
+			self.skipped[i] = 0
+		} else if len(queue) > 0 {
+			self.skipped[i]++
+		}
+	}
+}
+
+//某一级排队中的任务数
+func (self *scheduler) len(level byte) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.queues[self.index(level)])
+}
+
+//拒绝新任务，排队中的任务继续执行，取完后工人退出
+func (self *scheduler) drain() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.draining = true
+	self.notEmpty.Broadcast()
+	self.notFull.Broadcast()
+}
+
+//关闭队列，唤醒所有等待的工人和提交者，返回未执行的任务
+func (self *scheduler) close() []*Job {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	var jobs []*Job
+	for i, queue := range self.queues {
+		for _, job := range queue {
+			job.queued = false
+		}
+		jobs = append(jobs, queue...)
+		self.queues[i] = nil
+	}
+	self.size = 0
+	self.notEmpty.Broadcast()
+	self.notFull.Broadcast()
+	return jobs
+}
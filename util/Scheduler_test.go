@@ -0,0 +1,123 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+//按级别入队，返回出队顺序对应的级别
+func popLevels(sched *scheduler, n int) []byte {
+	levels := make([]byte, 0, n)
+	for i := 0; i < n; i++ {
+		job, ok := sched.pop()
+		if !ok {
+			break
+		}
+		levels = append(levels, job.args[0].(byte))
+	}
+	return levels
+}
+
+func pushLevel(sched *scheduler, level byte, n int) {
+	for i := 0; i < n; i++ {
+		sched.push(level, NewJob(nil, level))
+	}
+}
+
+func TestSchedStrict(t *testing.T) {
+	sched := newScheduler(SCHED_STRICT, []int{1, 1, 1}, 0x100)
+	pushLevel(sched, 3, 2)
+	pushLevel(sched, 2, 2)
+	pushLevel(sched, 1, 2)
+	//超出范围的放入最低优先级
+	pushLevel(sched, 9, 1)
+	got := popLevels(sched, 7)
+	want := []byte{1, 1, 2, 2, 3, 3, 9}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("order %v, want %v", got, want)
+		}
+	}
+}
+
+//各级都有任务时按权重比例执行
+func TestSchedWeighted(t *testing.T) {
+	sched := newScheduler(SCHED_WEIGHTED, []int{6, 3, 1}, 0x1000)
+	for level := byte(1); level <= 3; level++ {
+		pushLevel(sched, level, 1000)
+	}
+	count := make(map[byte]int)
+	for _, level := range popLevels(sched, 1000) {
+		count[level]++
+	}
+	if count[1] != 600 || count[2] != 300 || count[3] != 100 {
+		t.Fatalf("counts %v", count)
+	}
+}
+
+//权重为0的队列连续被跳过 SCHED_MAX_SKIP 次后执行一次
+func TestSchedStarvation(t *testing.T) {
+	sched := newScheduler(SCHED_WEIGHTED, []int{1, 0}, 0x1000)
+	pushLevel(sched, 1, 1000)
+	pushLevel(sched, 2, 10)
+	levels := popLevels(sched, 1000)
+	last := -1
+	for i, level := range levels {
+		if level != 2 {
+			continue
+		}
+		if i-last-1 > SCHED_MAX_SKIP {
+			t.Fatalf("level 2 skipped %d times", i-last-1)
+		}
+		last = i
+	}
+	if last < 0 {
+		t.Fatal("level 2 starved")
+	}
+}
+
+//容量为0时添加任务阻塞到被取走
+func TestSchedHandoff(t *testing.T) {
+	sched := newScheduler(SCHED_STRICT, []int{1}, 0)
+	pushed := make(chan bool, 1)
+	go func() { pushed <- sched.push(1, NewJob(nil, byte(1))) }()
+	select {
+	case <-pushed:
+		t.Fatal("push returned before the job was taken")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if levels := popLevels(sched, 1); len(levels) != 1 {
+		t.Fatal("no job")
+	}
+	select {
+	case ok := <-pushed:
+		if !ok {
+			t.Fatal("push failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push still blocked after the job was taken")
+	}
+	//关闭时阻塞的添加返回，任务由 close 交回
+	go func() { pushed <- sched.push(1, NewJob(nil, byte(1))) }()
+	time.Sleep(10 * time.Millisecond)
+	if jobs := sched.close(); len(jobs) != 1 {
+		t.Fatalf("close returned %d jobs", len(jobs))
+	}
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push still blocked after close")
+	}
+}
+
+func TestPriorityLevelsLimit(t *testing.T) {
+	if n := NewPriorityWorkPool(1000, 1, 1).Levels(); n != SCHED_MAX_LEVELS {
+		t.Fatalf("levels %d", n)
+	}
+	if n := NewPriorityWorkPool(0, 1, 1).Levels(); n != 1 {
+		t.Fatalf("levels %d", n)
+	}
+	if n := NewWeightedWorkPool(make([]int, 300), 1, 1).Levels(); n != SCHED_MAX_LEVELS {
+		t.Fatalf("levels %d", n)
+	}
+}
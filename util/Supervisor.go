@@ -0,0 +1,505 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//进程角色通过环境变量传递，不依赖父进程ID判断
+const (
+	SUPERVISOR_ENV    = "GO_SUPERVISOR_ROLE"
+	SUPERVISOR_KEEPER = "keeper" //守护进程
+	SUPERVISOR_CHILD  = "child"  //执行业务的子进程
+	//子进程的环境变量中守护进程的pid，平滑重启启动的新进程同样继承，用于把新进程交给守护进程
+	SUPERVISOR_KEEPER_PID_ENV = "GO_SUPERVISOR_KEEPER_PID"
+)
+
+const (
+	SUPERVISOR_MIN_BACKOFF = time.Second            //MinBackoff 未设置时的默认值
+	SUPERVISOR_MAX_BACKOFF = time.Minute            //MaxBackoff 未设置时的默认值
+	SUPERVISOR_ADOPT_POLL  = 200 * time.Millisecond //检查接管的进程是否存活的间隔
+)
+
+var (
+	ErrNoPidFile  = errors.New("supervisor: pid file not set")
+	ErrNotRunning = errors.New("supervisor: not running")
+)
+
+//守护进程，子进程异常退出后按退避时间重启，正常退出(退出码0)时守护进程随之退出
+//子进程平滑重启(例如 tcp.TCPServer.Restart)后需调用 SupervisorHandoff，守护进程在旧进程退出后接管新进程，
+//不会把旧进程的退出当作停止，在 systemd(Type=simple) 下守护进程始终是主进程，重启不会导致整个服务被结束
+type Supervisor struct {
+	Path        string        //子进程的可执行文件，默认当前程序
+	Args        []string      //子进程的参数，默认当前的命令行参数
+	PidFile     string        //守护进程的pid文件，同目录下的 .status 文件记录运行状态，空则不写
+	LogFile     string        //守护进程和子进程的输出重定向到这个文件，空则继承终端
+	LogMaxSize  int64         //日志超过这个大小时轮转，0 不轮转
+	LogBackups  int           //保留的旧日志数
+	MinBackoff  time.Duration //第一次重启前的等待时间，之后每次翻倍
+	MaxBackoff  time.Duration //重启等待时间的上限
+	StableTime  time.Duration //子进程运行超过这个时间视为稳定，退避时间重置
+	MaxRestarts int           //Window 内最多重启次数，超过后守护进程放弃并退出，0 不限
+	Window      time.Duration
+	Foreground  bool //在当前进程中守护子进程，不在后台另起守护进程，适合 systemd、容器等自带进程管理的环境
+	log         io.Writer
+}
+
+//运行状态，写在 PidFile + ".status"
+type SupervisorStatus struct {
+	Pid       int       `json:"pid"`       //守护进程
+	ChildPid  int       `json:"child_pid"` //当前子进程，重启等待中为0
+	Running   bool      `json:"running"`   //守护进程是否存活，读取状态时检测
+	Restarts  int       `json:"restarts"`
+	StartedAt time.Time `json:"started_at"` //当前子进程的启动时间
+	LastExit  string    `json:"last_exit"`  //上一个子进程的退出原因
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		MinBackoff: SUPERVISOR_MIN_BACKOFF,
+		MaxBackoff: SUPERVISOR_MAX_BACKOFF,
+		StableTime: time.Minute,
+		LogBackups: 5,
+		Window:     10 * time.Minute,
+		Foreground: underInit(),
+	}
+}
+
+//由 systemd 启动(设置了 INVOCATION_ID)或作为容器的1号进程运行时，后台运行会使进程管理器失去对进程的跟踪
+func underInit() bool {
+	return os.Getpid() == 1 || os.Getenv("INVOCATION_ID") != ""
+}
+
+//按进程角色执行，返回true的是执行业务的子进程，其它进程返回false后应直接退出
+//首次启动的进程在后台启动守护进程后返回，守护进程在子进程正常退出、放弃重启或收到 TERM/INT 后返回
+//Foreground 为true时首次启动的进程自己就是守护进程，阻塞到守护结束后返回
+//PidFile 中记录的守护进程还活着时不再启动新的守护进程
+func (self *Supervisor) Run() bool {
+	switch os.Getenv(SUPERVISOR_ENV) {
+	case SUPERVISOR_CHILD:
+		return true
+	case SUPERVISOR_KEEPER:
+		self.keep()
+		return false
+	}
+	if pid, ok := self.keeperAlive(); ok {
+		fmt.Println("Keeper already running, pid:", pid)
+		return false
+	}
+	if self.Foreground {
+		self.keep()
+		return false
+	}
+	if err := self.startKeeper(); err != nil {
+		fmt.Println("Keeper start failed:", err)
+		return false
+	}
+	fmt.Println("Keeper started !")
+	return false
+}
+
+//PidFile 记录的守护进程是否存活，是本进程时不算
+func (self *Supervisor) keeperAlive() (int, bool) {
+	status, err := self.Status()
+	if err != nil || status.Pid == os.Getpid() {
+		return 0, false
+	}
+	return status.Pid, status.Running
+}
+
+func (self *Supervisor) command(role string) (*exec.Cmd, error) {
+	path := self.Path
+	if path == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		path = exe
+	}
+	args := self.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(supervisorEnviron(), SUPERVISOR_ENV+"="+role)
+	if role == SUPERVISOR_CHILD {
+		cmd.Env = append(cmd.Env, SUPERVISOR_KEEPER_PID_ENV+"="+strconv.Itoa(os.Getpid()))
+	}
+	return cmd, nil
+}
+
+//去掉继承来的角色和守护进程pid
+func supervisorEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, SUPERVISOR_ENV+"=") && !strings.HasPrefix(kv, SUPERVISOR_KEEPER_PID_ENV+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+//子进程把平滑重启的新进程交给守护进程时写入的文件，内容为新进程的pid
+func handoffFile(keeperPid int) string {
+	return filepath.Join(os.TempDir(), "go-supervisor-"+strconv.Itoa(keeperPid)+".handoff")
+}
+
+//在守护的子进程中平滑重启后调用，process 为新启动的进程，例如 tcp.TCPServer.Restart 的返回值
+//守护进程在本进程退出后改为守护新进程，不是守护的子进程时不做任何事
+func SupervisorHandoff(process *os.Process) error {
+	if os.Getenv(SUPERVISOR_ENV) != SUPERVISOR_CHILD {
+		return nil
+	}
+	keeper, err := strconv.Atoi(os.Getenv(SUPERVISOR_KEEPER_PID_ENV))
+	if err != nil {
+		return ErrNotRunning
+	}
+	path := handoffFile(keeper)
+	if err := os.WriteFile(path+".tmp", []byte(strconv.Itoa(process.Pid)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+//取出子进程交接的新进程，没有交接或新进程已退出时返回0
+func takeHandoff() int {
+	path := handoffFile(os.Getpid())
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	os.Remove(path)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || !processAlive(pid) {
+		return 0
+	}
+	return pid
+}
+
+//在新会话中启动守护进程，脱离当前终端
+func (self *Supervisor) startKeeper() error {
+	cmd, err := self.command(SUPERVISOR_KEEPER)
+	if err != nil {
+		return err
+	}
+	if self.LogFile == "" {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+func (self *Supervisor) logf(format string, args ...interface{}) {
+	fmt.Fprintf(self.log, time.Now().Format("2006-01-02 15:04:05 ")+format+"\n", args...)
+}
+
+//守护进程的主循环
+func (self *Supervisor) keep() {
+	self.log = os.Stdout
+	if self.LogFile != "" {
+		writer, err := NewRotateWriter(self.LogFile, self.LogMaxSize, self.LogBackups)
+		if err != nil {
+			fmt.Println("open log file failed:", err)
+			return
+		}
+		defer writer.Close()
+		self.log = writer
+	}
+	status := &SupervisorStatus{Pid: os.Getpid()}
+	//两次启动间隔很短时 Run 可能都没看到对方的pid文件，这里再检查一次
+	if pid, ok := self.keeperAlive(); ok {
+		self.logf("supervisor: keeper %d already running, exit", pid)
+		return
+	}
+	if self.PidFile != "" {
+		if err := os.WriteFile(self.PidFile, []byte(strconv.Itoa(status.Pid)), 0644); err != nil {
+			self.logf("write pid file failed: %v", err)
+		}
+		defer os.Remove(self.PidFile)
+		defer os.Remove(self.statusFile())
+	}
+	os.Remove(handoffFile(status.Pid))
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, forwardSignals...)
+	defer signal.Stop(sigs)
+
+	//零值的 Supervisor 没有退避时间，子进程启动即失败时会不停重启
+	minBackoff, maxBackoff := self.MinBackoff, self.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = SUPERVISOR_MIN_BACKOFF
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = SUPERVISOR_MAX_BACKOFF
+		if maxBackoff < minBackoff {
+			maxBackoff = minBackoff
+		}
+	}
+	backoff := minBackoff
+	var restarts []time.Time
+	for {
+		cmd, err := self.command(SUPERVISOR_CHILD)
+		if err != nil {
+			self.logf("supervisor: %v", err)
+			return
+		}
+		cmd.Stdin = nil
+		cmd.Stdout = self.log
+		cmd.Stderr = self.log
+		started := time.Now()
+		if err = cmd.Start(); err == nil {
+			status.ChildPid = cmd.Process.Pid
+			status.StartedAt = started
+			self.writeStatus(status)
+			self.logf("supervisor: child %d started", cmd.Process.Pid)
+			stopping, werr := self.wait(cmd, sigs)
+			//子进程平滑重启后改为守护新进程
+			for !stopping {
+				pid := takeHandoff()
+				if pid == 0 {
+					break
+				}
+				status.ChildPid = pid
+				status.StartedAt = time.Now()
+				self.writeStatus(status)
+				self.logf("supervisor: child restarted as %d", pid)
+				started = status.StartedAt
+				stopping, werr = self.adopt(pid, sigs)
+			}
+			if werr == nil || stopping {
+				self.logf("supervisor: child %d exited: %v, stop", cmd.Process.Pid, werr)
+				return
+			}
+			err = werr
+		}
+		status.ChildPid = 0
+		status.LastExit = err.Error()
+		self.logf("supervisor: child exited: %v", err)
+		//运行稳定后重新计算退避时间
+		if time.Since(started) >= self.StableTime {
+			backoff = minBackoff
+		}
+		now := time.Now()
+		restarts = append(restarts, now)
+		for len(restarts) > 0 && now.Sub(restarts[0]) > self.Window {
+			restarts = restarts[1:]
+		}
+		if self.MaxRestarts > 0 && len(restarts) > self.MaxRestarts {
+			self.logf("supervisor: %d restarts within %v, give up", len(restarts), self.Window)
+			return
+		}
+		status.Restarts++
+		self.writeStatus(status)
+		self.logf("supervisor: restart in %v", backoff)
+		if !self.sleep(backoff, sigs) {
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+//等待子进程退出，期间把收到的信号转发给子进程，收到停止信号时 stopping 为true
+func (self *Supervisor) wait(cmd *exec.Cmd, sigs chan os.Signal) (stopping bool, err error) {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	for {
+		select {
+		case err = <-done:
+			return
+		case sig := <-sigs:
+			self.logf("supervisor: forward %v to child %d", sig, cmd.Process.Pid)
+			forwardSignal(cmd.Process, sig)
+			if isStopSignal(sig) {
+				stopping = true
+			}
+		}
+	}
+}
+
+//等待接管的进程退出，它不是本进程的子进程，只能定时检查是否存活，也取不到退出码，退出后按异常退出处理
+func (self *Supervisor) adopt(pid int, sigs chan os.Signal) (stopping bool, err error) {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false, err
+	}
+	ticker := time.NewTicker(SUPERVISOR_ADOPT_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			//守护进程是1号进程时新进程由它回收
+			reapChild(pid)
+			if !processAlive(pid) {
+				return stopping, fmt.Errorf("process %d exited", pid)
+			}
+		case sig := <-sigs:
+			self.logf("supervisor: forward %v to child %d", sig, pid)
+			forwardSignal(process, sig)
+			if isStopSignal(sig) {
+				stopping = true
+			}
+		}
+	}
+}
+
+//重启前等待，期间收到停止信号返回false
+func (self *Supervisor) sleep(d time.Duration, sigs chan os.Signal) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case sig := <-sigs:
+			if isStopSignal(sig) {
+				self.logf("supervisor: %v received while waiting to restart, stop", sig)
+				return false
+			}
+		}
+	}
+}
+
+func (self *Supervisor) statusFile() string {
+	return self.PidFile + ".status"
+}
+
+func (self *Supervisor) writeStatus(status *SupervisorStatus) {
+	if self.PidFile == "" {
+		return
+	}
+	data, _ := json.Marshal(status)
+	tmp := self.statusFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err == nil {
+		os.Rename(tmp, self.statusFile())
+	}
+}
+
+//读取守护进程的运行状态，可在命令行中实现 status 子命令，例如
+//
+//	if util.GetFirstArg() == "status" { st, err := sup.Status(); ... }
+func (self *Supervisor) Status() (*SupervisorStatus, error) {
+	if self.PidFile == "" {
+		return nil, ErrNoPidFile
+	}
+	data, err := os.ReadFile(self.PidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotRunning
+		}
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	status := &SupervisorStatus{Pid: pid}
+	if data, err := os.ReadFile(self.statusFile()); err == nil {
+		json.Unmarshal(data, status)
+		//状态文件是之前的守护进程留下的，不属于pid文件中的进程
+		if status.Pid != pid {
+			status = &SupervisorStatus{Pid: pid}
+		}
+	}
+	status.Running = processAlive(pid)
+	return status, nil
+}
+
+//向守护进程发送信号，TERM/INT 停止守护进程和子进程，其它信号转发给子进程
+func (self *Supervisor) Signal(sig os.Signal) error {
+	status, err := self.Status()
+	if err != nil {
+		return err
+	}
+	if !status.Running {
+		return ErrNotRunning
+	}
+	process, err := os.FindProcess(status.Pid)
+	if err != nil {
+		return err
+	}
+	return process.Signal(sig)
+}
+
+//按大小轮转的日志文件，path 超过 maxSize 后依次改名为 path.1 ... path.backups
+type RotateWriter struct {
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+	lock    sync.Mutex
+}
+
+func NewRotateWriter(path string, maxSize int64, backups int) (*RotateWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	writer := &RotateWriter{path: path, maxSize: maxSize, backups: backups}
+	if err := writer.open(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (self *RotateWriter) open() error {
+	file, err := os.OpenFile(self.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	self.file = file
+	self.size = info.Size()
+	return nil
+}
+
+func (self *RotateWriter) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.maxSize > 0 && self.size > 0 && self.size+int64(len(p)) > self.maxSize {
+		if err := self.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := self.file.Write(p)
+	self.size += int64(n)
+	return n, err
+}
+
+//需持有锁
+func (self *RotateWriter) rotate() error {
+	self.file.Close()
+	if self.backups > 0 {
+		for i := self.backups - 1; i > 0; i-- {
+			os.Rename(self.path+"."+strconv.Itoa(i), self.path+"."+strconv.Itoa(i+1))
+		}
+		os.Rename(self.path, self.path+".1")
+	} else {
+		os.Remove(self.path)
+	}
+	return self.open()
+}
+
+func (self *RotateWriter) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.file.Close()
+}
@@ -0,0 +1,242 @@
+package util
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//由守护进程启动的测试子进程，行为由 SUPERVISOR_TEST_MODE 决定
+func TestSupervisorHelper(t *testing.T) {
+	if os.Getenv(SUPERVISOR_ENV) != SUPERVISOR_CHILD {
+		return
+	}
+	switch os.Getenv("SUPERVISOR_TEST_MODE") {
+	case "handoff":
+		//模拟平滑重启：启动新进程并交给守护进程，自己正常退出
+		if os.Getenv("SUPERVISOR_TEST_SUCCESSOR") == "" {
+			cmd := exec.Command(os.Args[0], os.Args[1:]...)
+			cmd.Env = append(os.Environ(), "SUPERVISOR_TEST_SUCCESSOR=1")
+			if cmd.Start() != nil || SupervisorHandoff(cmd.Process) != nil {
+				os.Exit(2)
+			}
+			os.Exit(0)
+		}
+		time.Sleep(100 * time.Millisecond)
+		os.Exit(3)
+	case "fail":
+		//运行 SUPERVISOR_TEST_SLEEP 后异常退出，第 SUPERVISOR_TEST_FAILS 次之后正常退出
+		counter := os.Getenv("SUPERVISOR_TEST_COUNTER")
+		data, _ := os.ReadFile(counter)
+		runs, _ := strconv.Atoi(string(data))
+		runs++
+		os.WriteFile(counter, []byte(strconv.Itoa(runs)), 0644)
+		sleep, _ := time.ParseDuration(os.Getenv("SUPERVISOR_TEST_SLEEP"))
+		time.Sleep(sleep)
+		if fails, _ := strconv.Atoi(os.Getenv("SUPERVISOR_TEST_FAILS")); runs <= fails {
+			os.Exit(3)
+		}
+	}
+	os.Exit(0)
+}
+
+func newTestSupervisor(t *testing.T, mode string) *Supervisor {
+	t.Setenv("SUPERVISOR_TEST_MODE", mode)
+	dir := t.TempDir()
+	return &Supervisor{
+		Path:       os.Args[0],
+		Args:       []string{"-test.run=^TestSupervisorHelper$"},
+		PidFile:    filepath.Join(dir, "keeper.pid"),
+		LogFile:    filepath.Join(dir, "keeper.log"),
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		Window:     time.Minute,
+	}
+}
+
+//异常退出 fails 次的子进程，每次运行 sleep 时间，返回读取运行次数的函数
+func failingChild(t *testing.T, fails int, sleep time.Duration) (runs func() int) {
+	counter := filepath.Join(t.TempDir(), "runs")
+	t.Setenv("SUPERVISOR_TEST_COUNTER", counter)
+	t.Setenv("SUPERVISOR_TEST_FAILS", strconv.Itoa(fails))
+	t.Setenv("SUPERVISOR_TEST_SLEEP", sleep.String())
+	return func() int {
+		data, _ := os.ReadFile(counter)
+		n, _ := strconv.Atoi(string(data))
+		return n
+	}
+}
+
+//日志中每次重启前的等待时间
+func restartDelays(log string) []string {
+	var delays []string
+	for _, line := range strings.Split(log, "\n") {
+		if i := strings.Index(line, "restart in "); i >= 0 {
+			delays = append(delays, line[i+len("restart in "):])
+		}
+	}
+	return delays
+}
+
+//在本进程中运行守护循环，返回守护进程的日志
+func runKeeper(t *testing.T, sup *Supervisor) string {
+	done := make(chan struct{})
+	go func() {
+		sup.keep()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("keeper did not stop")
+	}
+	data, err := os.ReadFile(sup.LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+//子进程交接后正常退出，守护进程接管新进程，新进程退出后照常重启
+func TestSupervisorHandoff(t *testing.T) {
+	sup := newTestSupervisor(t, "handoff")
+	sup.MaxRestarts = 1
+	log := runKeeper(t, sup)
+	if n := strings.Count(log, "restarted as"); n != 2 {
+		t.Fatalf("%d handoffs\n%s", n, log)
+	}
+	if !strings.Contains(log, "give up") {
+		t.Fatalf("keeper did not give up\n%s", log)
+	}
+	if _, err := os.Stat(sup.PidFile); !os.IsNotExist(err) {
+		t.Fatal("pid file left behind")
+	}
+}
+
+//退避时间从 MinBackoff 开始翻倍，不超过 MaxBackoff，子进程正常退出后守护进程停止
+func TestSupervisorBackoff(t *testing.T) {
+	sup := newTestSupervisor(t, "fail")
+	runs := failingChild(t, 4, 0)
+	sup.MaxBackoff = 40 * time.Millisecond
+	sup.StableTime = time.Minute
+	log := runKeeper(t, sup)
+	want := []string{"10ms", "20ms", "40ms", "40ms"}
+	if got := restartDelays(log); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("delays %v, want %v\n%s", got, want, log)
+	}
+	if runs() != 5 || !strings.Contains(log, "stop") {
+		t.Fatalf("%d runs\n%s", runs(), log)
+	}
+}
+
+//运行超过 StableTime 的子进程退出后，退避时间重置为 MinBackoff
+func TestSupervisorStableReset(t *testing.T) {
+	sup := newTestSupervisor(t, "fail")
+	failingChild(t, 3, 30*time.Millisecond)
+	sup.MaxBackoff = time.Second
+	sup.StableTime = 20 * time.Millisecond
+	log := runKeeper(t, sup)
+	for _, delay := range restartDelays(log) {
+		if delay != "10ms" {
+			t.Fatalf("backoff not reset\n%s", log)
+		}
+	}
+}
+
+//Window 内重启超过 MaxRestarts 次后放弃
+func TestSupervisorGiveUp(t *testing.T) {
+	sup := newTestSupervisor(t, "fail")
+	runs := failingChild(t, 10, 0)
+	sup.MaxRestarts = 2
+	log := runKeeper(t, sup)
+	if runs() != 3 || !strings.Contains(log, "give up") {
+		t.Fatalf("%d runs\n%s", runs(), log)
+	}
+	status, err := sup.Status()
+	if err != ErrNotRunning {
+		t.Fatalf("status %+v, err %v", status, err)
+	}
+}
+
+//超出 Window 的重启不计数
+func TestSupervisorWindow(t *testing.T) {
+	sup := newTestSupervisor(t, "fail")
+	runs := failingChild(t, 3, 30*time.Millisecond)
+	sup.MaxRestarts = 1
+	sup.Window = 20 * time.Millisecond
+	log := runKeeper(t, sup)
+	if runs() != 4 || strings.Contains(log, "give up") {
+		t.Fatalf("%d runs\n%s", runs(), log)
+	}
+}
+
+//pid文件中的进程已退出时状态为未运行，Signal 返回 ErrNotRunning
+func TestSupervisorStalePidFile(t *testing.T) {
+	if _, err := (&Supervisor{}).Status(); err != ErrNoPidFile {
+		t.Fatalf("want ErrNoPidFile, got %v", err)
+	}
+	sup := newTestSupervisor(t, "")
+	if _, err := sup.Status(); err != ErrNotRunning {
+		t.Fatalf("want ErrNotRunning, got %v", err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(sup.PidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	sup.writeStatus(&SupervisorStatus{Pid: cmd.Process.Pid, ChildPid: 42, Restarts: 3})
+	status, err := sup.Status()
+	if err != nil || status.Running || status.ChildPid != 42 || status.Restarts != 3 {
+		t.Fatalf("status %+v, err %v", status, err)
+	}
+	if err := sup.Signal(os.Interrupt); err != ErrNotRunning {
+		t.Fatalf("want ErrNotRunning, got %v", err)
+	}
+	if _, alive := sup.keeperAlive(); alive {
+		t.Fatal("stale keeper reported alive")
+	}
+	//记录的是本进程时不算已有守护进程，之前的守护进程留下的状态文件不使用
+	os.WriteFile(sup.PidFile, []byte(strconv.Itoa(os.Getpid())), 0644)
+	if status, err := sup.Status(); err != nil || !status.Running || status.Pid != os.Getpid() || status.ChildPid != 0 {
+		t.Fatalf("status %+v, err %v", status, err)
+	}
+	if _, alive := sup.keeperAlive(); alive {
+		t.Fatal("own pid reported as another keeper")
+	}
+}
+
+//超过大小后轮转，只保留 backups 个旧文件，重新打开时接着原大小计算
+func TestRotateWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "app.log")
+	writer, err := NewRotateWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+	for suffix, want := range map[string]string{"": "dddddd\n", ".1": "cccccc\n", ".2": "bbbbbb\n"} {
+		if data, err := os.ReadFile(path + suffix); err != nil || string(data) != want {
+			t.Fatalf("%s: %q %v", suffix, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("too many backups")
+	}
+	writer, _ = NewRotateWriter(path, 10, 0)
+	writer.Write([]byte("eeeeee\n"))
+	writer.Close()
+	if data, _ := os.ReadFile(path); string(data) != "eeeeee\n" {
+		t.Fatalf("without backups: %q", data)
+	}
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "cccccc\n" {
+		t.Fatalf("backup touched: %q", data)
+	}
+}
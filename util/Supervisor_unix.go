@@ -0,0 +1,52 @@
+//go:build !windows
+
+package util
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+//转发给子进程的信号
+var forwardSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1}
+
+func isStopSignal(sig os.Signal) bool {
+	return sig == syscall.SIGTERM || sig == syscall.SIGINT
+}
+
+func forwardSignal(process *os.Process, sig os.Signal) error {
+	return process.Signal(sig)
+}
+
+//新会话中运行，关闭终端不影响守护进程
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil && !zombie(pid)
+}
+
+//已退出但还没有被父进程回收，只在有 /proc 的系统上能判断
+func zombie(pid int) bool {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	//进程名中可能有空格和括号，状态在最后一个 ')' 之后
+	i := bytes.LastIndexByte(data, ')')
+	return i >= 0 && i+2 < len(data) && data[i+2] == 'Z'
+}
+
+//回收已退出的子进程，pid 不是本进程的子进程时什么也不做
+func reapChild(pid int) {
+	var status syscall.WaitStatus
+	syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+}
@@ -0,0 +1,36 @@
+//go:build windows
+
+package util
+
+import (
+	"os"
+	"os/exec"
+)
+
+//windows 只能接收中断信号
+var forwardSignals = []os.Signal{os.Interrupt}
+
+func isStopSignal(sig os.Signal) bool {
+	return true
+}
+
+//windows 不支持向其它进程发送中断信号，直接结束子进程
+func forwardSignal(process *os.Process, sig os.Signal) error {
+	return process.Kill()
+}
+
+func detach(cmd *exec.Cmd) {
+}
+
+//windows 上 FindProcess 会打开进程句柄，进程不存在时返回错误
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+func reapChild(pid int) {
+}
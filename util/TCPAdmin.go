@@ -0,0 +1,166 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/zdq007/go-common/tcp"
+)
+
+const (
+	TCP_ADMIN_MAX_BODY = 0xFFFF //广播消息的最大长度，不超过 PROTO_BYTE 单个包的数据长度
+)
+
+//连接信息
+type TCPClientInfo struct {
+	Id          uint64                 `json:"id"`
+	Addr        string                 `json:"addr"`
+	ConnectedAt time.Time              `json:"connected_at"`
+	Age         string                 `json:"age"`
+	Attrs       map[string]interface{} `json:"attrs"`
+	Rooms       []string               `json:"rooms"`
+	Stats       tcp.ClientStats        `json:"stats"`
+}
+
+//挂载TCP连接管理接口，auth 返回false的请求回复403，auth 为nil时只允许本机访问
+//
+//	GET  /debug/tcp/clients               在线连接列表
+//	GET  /debug/tcp/clients/:id           单个连接
+//	POST /debug/tcp/clients/:id/kick      踢掉连接
+//	GET  /debug/tcp/rooms                 房间和成员ID
+//	GET  /debug/tcp/rooms/:room           房间成员
+//	POST /debug/tcp/broadcast?room=&msgtype=  广播请求体，room 为空发给所有连接，msgtype 只对 PROTO_BYTE 有效
+func StartTCPAdmin(router *httprouter.Router, ser *tcp.TCPServer, auth func(r *http.Request) bool) {
+	if auth == nil {
+		auth = localOnly
+	}
+	guard := func(handle httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			if !auth(r) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			handle(w, r, ps)
+		}
+	}
+	router.GET("/debug/tcp/clients", guard(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		clients := ser.Clients()
+		infos := make([]*TCPClientInfo, 0, len(clients))
+		for _, client := range clients {
+			infos = append(infos, tcpClientInfo(client))
+		}
+		writeJson(w, infos)
+	}))
+	router.GET("/debug/tcp/clients/:id", guard(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if client := lookupClient(w, ser, ps); client != nil {
+			writeJson(w, tcpClientInfo(client))
+		}
+	}))
+	router.POST("/debug/tcp/clients/:id/kick", guard(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if client := lookupClient(w, ser, ps); client != nil {
+			client.Kick()
+			writeJson(w, map[string]interface{}{"kicked": client.Id()})
+		}
+	}))
+	router.GET("/debug/tcp/rooms", guard(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		rooms := make(map[string][]uint64)
+		for _, room := range ser.RoomNames() {
+			rooms[room] = clientIds(ser.RoomMembers(room))
+		}
+		writeJson(w, rooms)
+	}))
+	router.GET("/debug/tcp/rooms/:room", guard(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		members := ser.RoomMembers(ps.ByName("room"))
+		infos := make([]*TCPClientInfo, 0, len(members))
+		for _, client := range members {
+			infos = append(infos, tcpClientInfo(client))
+		}
+		writeJson(w, infos)
+	}))
+	router.POST("/debug/tcp/broadcast", guard(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, TCP_ADMIN_MAX_BODY+1))
+		if err != nil || len(body) > TCP_ADMIN_MAX_BODY {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		var packet []byte
+		if ser.GetProto() == tcp.PROTO_BYTE {
+			msgtype, err := strconv.ParseUint(r.URL.Query().Get("msgtype"), 10, 8)
+			if err != nil {
+				http.Error(w, "bad msgtype", http.StatusBadRequest)
+				return
+			}
+			packet = tcp.WarpData(byte(msgtype), body)
+		} else {
+			packet = body
+			if len(packet) < 2 || packet[len(packet)-2] != '\r' || packet[len(packet)-1] != '\n' {
+				packet = append(packet, '\r', '\n')
+			}
+		}
+		sent := ser.Broadcast(r.URL.Query().Get("room"), packet)
+		writeJson(w, map[string]interface{}{"sent": sent})
+	}))
+	fmt.Println("tcp admin url:\n", "/debug/tcp/clients\n", "/debug/tcp/clients/:id\n", "/debug/tcp/clients/:id/kick\n",
+		"/debug/tcp/rooms\n", "/debug/tcp/rooms/:room\n", "/debug/tcp/broadcast")
+}
+
+//只允许本机访问
+func localOnly(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func lookupClient(w http.ResponseWriter, ser *tcp.TCPServer, ps httprouter.Params) *tcp.Client {
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return nil
+	}
+	client := ser.GetClient(id)
+	if client == nil {
+		http.Error(w, "client not found", http.StatusNotFound)
+	}
+	return client
+}
+
+func tcpClientInfo(client *tcp.Client) *TCPClientInfo {
+	attrs := client.Attrs().All()
+	for key, val := range attrs {
+		//不能序列化的值(函数、通道等)转为字符串
+		if _, err := json.Marshal(val); err != nil {
+			attrs[key] = fmt.Sprint(val)
+		}
+	}
+	return &TCPClientInfo{
+		Id:          client.Id(),
+		Addr:        client.RemoteAddr(),
+		ConnectedAt: client.ConnectTime(),
+		Age:         time.Since(client.ConnectTime()).Truncate(time.Second).String(),
+		Attrs:       attrs,
+		Rooms:       client.Rooms(),
+		Stats:       client.Stats(),
+	}
+}
+
+func clientIds(clients []*tcp.Client) []uint64 {
+	ids := make([]uint64, 0, len(clients))
+	for _, client := range clients {
+		ids = append(ids, client.Id())
+	}
+	return ids
+}
+
+func writeJson(w http.ResponseWriter, val interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(val)
+}
@@ -1,33 +1,160 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type WorkPool struct {
-	allowLevel     bool
-	jobpipe_level1 chan *Job //三个优先级
-	jobpipe_level2 chan *Job
-	jobpipe_level3 chan *Job
-	workers        []*Worker
-	locker         *sync.Mutex
+	sched   *scheduler //多级任务队列
+	workers []*Worker
+	locker  *sync.Mutex
 	//checkrun       bool  //检测协程是否工作
-	initSize int32 //初始化指定的工人大小
-	delSize  int32 //异常销毁的个人大小
+	initSize int32           //初始化指定的工人大小
+	delSize  int32           //异常销毁的个人大小
+	ctx      context.Context //Stop 时取消，所有 context 任务都派生自它
+	cancel   context.CancelFunc
+	running  sync.WaitGroup //未退出的工人
+	stats    workPoolStats
+}
+
+//任务统计
+type WorkPoolStats struct {
+	Completed uint64 //执行完成的任务
+	Skipped   uint64 //开始前 context 已取消而跳过的任务
+	Timeouts  uint64 //超过各自 timeout 被放弃的任务
+	Cancelled uint64 //执行中 context 被取消的任务，不限时的任务取消后即使正常返回也计入这里
+	Abandoned int64  //被放弃后仍在运行的限时任务协程数，持续增长说明任务没有响应 ctx.Done()
+}
+
+type workPoolStats struct {
+	completed uint64
+	skipped   uint64
+	timeouts  uint64
+	cancelled uint64
+	abandoned int64
 }
 type Worker struct {
-	code   int32     //编号
-	status byte      //工作状态 0待命  1工作中 2 deal
-	delcmd chan bool //销毁命令
+	code   int32 //编号
+	status byte  //工作状态 0待命  1工作中 2 deal
 }
 type Job struct {
-	fun  func(...interface{})
-	args []interface{}
+	fun     func(...interface{})
+	args    []interface{}
+	ctx     context.Context //非nil时为 context 任务，执行 ctxfun
+	ctxfun  func(ctx context.Context)
+	timeout time.Duration //context 任务的执行时限，<=0 不限
+	future  *Future       //跳过或放弃时通知提交者
+	queued  bool          //在队列中等待，由 scheduler 的锁保护
+}
+
+func (self *Job) proc(pool *WorkPool) {
+	if self.ctx == nil {
+		self.fun(self.args...)
+		atomic.AddUint64(&pool.stats.completed, 1)
+		return
+	}
+	ctx, cancel := pool.jobContext(self.ctx, self.timeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		atomic.AddUint64(&pool.stats.skipped, 1)
+		self.fail(err)
+		return
+	}
+	if self.timeout <= 0 {
+		self.ctxfun(ctx)
+		if err := ctx.Err(); err != nil {
+			self.abort(pool, err)
+			return
+		}
+		atomic.AddUint64(&pool.stats.completed, 1)
+		return
+	}
+	//限时任务在单独的协程中执行，超时后工人不再等待，任务需自行响应 ctx 退出
+	//state 0 执行中 1 已结束 2 已放弃，由先改变它的一方决定任务算完成还是放弃
+	var state int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if !atomic.CompareAndSwapInt32(&state, 0, 1) {
+				atomic.AddInt64(&pool.stats.abandoned, -1)
+			}
+		}()
+		defer func() {
+			if err := recover(); err != nil {
+				fmt.Println("任务异常结束！", err)
+			}
+		}()
+		self.ctxfun(ctx)
+	}()
+	select {
+	case <-done:
+		atomic.AddUint64(&pool.stats.completed, 1)
+	case <-ctx.Done():
+		//任务恰好在截止时完成，结果已经交给 Future，不算超时
+		if self.future != nil && self.future.finished() {
+			atomic.AddUint64(&pool.stats.completed, 1)
+			return
+		}
+		//先计数再放弃，协程结束时的减一不会早于这里的加一
+		atomic.AddInt64(&pool.stats.abandoned, 1)
+		if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+			atomic.AddInt64(&pool.stats.abandoned, -1)
+			atomic.AddUint64(&pool.stats.completed, 1)
+			return
+		}
+		self.abort(pool, ctx.Err())
+	}
+}
+
+//任务因 ctx 结束被放弃，按原因计数
+func (self *Job) abort(pool *WorkPool, err error) {
+	if err == context.DeadlineExceeded {
+		atomic.AddUint64(&pool.stats.timeouts, 1)
+	} else {
+		atomic.AddUint64(&pool.stats.cancelled, 1)
+	}
+	self.fail(err)
+}
+
+//在工作池之外同步执行任务，用于处理 Shutdown 交回的任务，例如 for _, job := range jobs { job.Run() }
+//context 任务按提交时的 ctx 和 timeout 执行，ctx 已结束时不执行
+//交回的任务的 Future 已经以 ErrPoolClosed 结束，Run 的结果不会再通知提交者
+func (self *Job) Run() {
+	if self.ctx == nil {
+		self.fun(self.args...)
+		return
+	}
+	if self.ctx.Err() != nil {
+		return
+	}
+	ctx := self.ctx
+	if self.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.timeout)
+		defer cancel()
+	}
+	self.ctxfun(ctx)
 }
 
-func (self *Job) proc() {
-	self.fun(self.args...)
+//Submit 提交的任务的结果，其它任务为nil
+func (self *Job) Future() *Future {
+	return self.future
+}
+
+//context 任务提交时的 ctx，普通任务为nil
+func (self *Job) Context() context.Context {
+	return self.ctx
+}
+
+func (self *Job) fail(err error) {
+	if self.future != nil {
+		self.future.complete(nil, err)
+	}
 }
 func NewJob(fun func(...interface{}), args ...interface{}) *Job {
 	return &Job{
@@ -36,90 +163,149 @@ func NewJob(fun func(...interface{}), args ...interface{}) *Job {
 	}
 }
 func (self *WorkPool) Toplen() int {
-	return len(self.jobpipe_level1)
+	return self.sched.len(1)
+}
+
+//某一级排队中的任务数
+func (self *WorkPool) Len(level byte) int {
+	return self.sched.len(level)
+}
+
+//优先级数量
+func (self *WorkPool) Levels() int {
+	return len(self.sched.queues)
 }
 func (self *WorkPool) AddTopJob(fun func(...interface{}), args ...interface{}) {
-	job := NewJob(fun, args...)
-	self.jobpipe_level1 <- job
+	self.addJob(1, NewJob(fun, args...))
 }
 func (self *WorkPool) AddCenterJob(fun func(...interface{}), args ...interface{}) {
-	job := NewJob(fun, args...)
-	if self.allowLevel {
-		self.jobpipe_level2 <- job
-	} else {
-		self.jobpipe_level1 <- job
-	}
+	self.addJob(2, NewJob(fun, args...))
 }
 func (self *WorkPool) AddFootJob(fun func(...interface{}), args ...interface{}) {
-	job := NewJob(fun, args...)
-	if self.allowLevel {
-		self.jobpipe_level3 <- job
-	} else {
-		self.jobpipe_level1 <- job
-	}
+	self.addJob(3, NewJob(fun, args...))
 }
 
 /**
- *添加JOB
+ *添加JOB，level 从1开始，1 最优先，超出范围的放入最低优先级，队列满时阻塞
  **/
 func (self *WorkPool) AddJob(level byte, fun func(...interface{}), args ...interface{}) {
-	job := NewJob(fun, args...)
-	if self.allowLevel {
-		switch level {
-		case 1:
-			self.jobpipe_level1 <- job
-		case 2:
-			self.jobpipe_level2 <- job
-		default:
-			self.jobpipe_level3 <- job
-		}
-	} else {
-		self.jobpipe_level1 <- job
+	self.addJob(level, NewJob(fun, args...))
+}
+
+//添加接收 context 的JOB，开始前 ctx 已取消的不执行，执行超过 timeout 或工作池 Stop 时 ctx 被取消
+//timeout<=0 不限时，限时任务超时后工人转去执行其它任务，任务应及时响应 ctx.Done() 退出
+func (self *WorkPool) AddJobCtx(ctx context.Context, level byte, timeout time.Duration, fun func(ctx context.Context)) {
+	self.addJob(level, &Job{ctx: ctx, ctxfun: fun, timeout: timeout})
+}
+
+//工作池已停止时丢弃任务，Future 返回 ErrPoolClosed
+func (self *WorkPool) addJob(level byte, job *Job) {
+	if !self.sched.push(level, job) {
+		job.fail(ErrPoolClosed)
 	}
 }
 func NewWorker(code int32) *Worker {
-	return &Worker{code: code, delcmd: make(chan bool)}
+	return &Worker{code: code}
 }
 
-//只有一个级别的pool
+//只有一个级别的pool，queuenum 为0时添加任务阻塞到有工人取走
 func NewWorkPool(queuenum, worknum int32) *WorkPool {
-	return newWorkPool(false, queuenum, worknum)
+	return newWorkPool(newScheduler(SCHED_STRICT, []int{1}, int(queuenum)), worknum)
 }
 
-//支持优先级的pool
+//支持三个优先级的pool，严格按优先级执行
 func NewLevelWorkPool(queuenum, worknum int32) *WorkPool {
-	return newWorkPool(true, queuenum, worknum)
-}
-
-func newWorkPool(allowlevel bool, queuenum, worknum int32) (pool *WorkPool) {
-	if allowlevel {
-		pool = &WorkPool{
-			jobpipe_level1: make(chan *Job, queuenum),
-			jobpipe_level2: make(chan *Job, queuenum),
-			jobpipe_level3: make(chan *Job, queuenum),
-			workers:        make([]*Worker, 0, worknum),
-			locker:         new(sync.Mutex),
-			allowLevel:     allowlevel,
-			initSize:       worknum,
-		}
-	} else {
-		pool = &WorkPool{
-			jobpipe_level1: make(chan *Job, queuenum),
-			workers:        make([]*Worker, 0, worknum),
-			locker:         new(sync.Mutex),
-			allowLevel:     allowlevel,
-			initSize:       worknum,
+	return NewPriorityWorkPool(3, queuenum, worknum)
+}
+
+//支持 levels 个优先级的pool，严格按优先级执行：有高优先级任务时不执行低优先级任务，每级队列容量为 queuenum
+//levels 限制在 1~SCHED_MAX_LEVELS 之间
+func NewPriorityWorkPool(levels int, queuenum, worknum int32) *WorkPool {
+	if levels < 1 {
+		levels = 1
+	}
+	if levels > SCHED_MAX_LEVELS {
+		levels = SCHED_MAX_LEVELS
+	}
+	weights := make([]int, levels)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return newWorkPool(newScheduler(SCHED_STRICT, weights, int(queuenum)), worknum)
+}
+
+//按权重分配执行机会的pool，weights[i] 为第 i+1 级的权重，例如 []int{6, 3, 1}
+//各级有任务时按权重比例执行，低权重或权重为0的队列连续被跳过 SCHED_MAX_SKIP 次后执行一次，不会饿死
+//超过 SCHED_MAX_LEVELS 的权重被忽略
+func NewWeightedWorkPool(weights []int, queuenum, worknum int32) *WorkPool {
+	if len(weights) == 0 {
+		weights = []int{1}
+	}
+	if len(weights) > SCHED_MAX_LEVELS {
+		weights = weights[:SCHED_MAX_LEVELS]
+	}
+	ws := make([]int, len(weights))
+	for i, weight := range weights {
+		if weight > 0 {
+			ws[i] = weight
 		}
 	}
+	return newWorkPool(newScheduler(SCHED_WEIGHTED, ws, int(queuenum)), worknum)
+}
+
+func newWorkPool(sched *scheduler, worknum int32) (pool *WorkPool) {
+	pool = &WorkPool{
+		sched:    sched,
+		workers:  make([]*Worker, 0, worknum),
+		locker:   new(sync.Mutex),
+		initSize: worknum,
+	}
+	pool.ctx, pool.cancel = context.WithCancel(context.Background())
 	for i := int32(0); i < worknum; i++ {
 		pool.workers = append(pool.workers, NewWorker(i))
 	}
 	return
 }
 
+//工作池的 context，Stop 时取消
+func (self *WorkPool) Context() context.Context {
+	return self.ctx
+}
+
+//任务的 context，在 parent、工作池 Stop 或 timeout 任一结束时取消
+func (self *WorkPool) jobContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(self.ctx, cancel)
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		return ctx, func() {
+			stop()
+			cancelTimeout()
+			cancel()
+		}
+	}
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+//任务统计
+func (self *WorkPool) Stats() WorkPoolStats {
+	return WorkPoolStats{
+		Completed: atomic.LoadUint64(&self.stats.completed),
+		Skipped:   atomic.LoadUint64(&self.stats.skipped),
+		Timeouts:  atomic.LoadUint64(&self.stats.timeouts),
+		Cancelled: atomic.LoadUint64(&self.stats.cancelled),
+		Abandoned: atomic.LoadInt64(&self.stats.abandoned),
+	}
+}
+
 func (self *WorkPool) Run() {
 	self.locker.Lock()
 	defer self.locker.Unlock()
+	self.running.Add(len(self.workers))
 	for _, worker := range self.workers {
 		go worker.work(self)
 	}
@@ -130,17 +316,61 @@ func (self *WorkPool) Run() {
 func (self *WorkPool) GetDelSize() int32 {
 	return self.delSize
 }
+
+//立即停止，取消执行中的 context 任务并丢弃排队中的任务，不等待工人退出，需要等待时调用 Wait
 func (self *WorkPool) Stop() {
 	self.locker.Lock()
 	defer self.locker.Unlock()
 	//self.checkrun = false
-	for _, worker := range self.workers {
-		worker.delcmd <- true
+	//先取消正在执行和排队中的 context 任务
+	self.cancel()
+	//工人执行完手头的任务后退出，未执行的任务丢弃
+	failJobs(self.sched.close())
+}
+
+//等待所有工人退出，在 Stop 或 Shutdown 之后调用
+func (self *WorkPool) Wait() {
+	self.running.Wait()
+}
+
+//平滑关闭：拒绝新任务，等待排队中的任务执行完、工人退出
+//ctx 先结束时不再等待，取消执行中的 context 任务，返回未执行的任务和 ctx.Err()
+//返回的任务的 Future 以 ErrPoolClosed 结束，需要时可以用 Job.Run 自行执行或持久化后重新提交
+func (self *WorkPool) Shutdown(ctx context.Context) ([]*Job, error) {
+	return self.shutdown(ctx, false)
+}
+
+//拒绝新任务并丢弃排队中的任务，等待执行中的任务结束，返回被丢弃的任务
+func (self *WorkPool) ShutdownNow(ctx context.Context) ([]*Job, error) {
+	return self.shutdown(ctx, true)
+}
+
+func (self *WorkPool) shutdown(ctx context.Context, discard bool) (jobs []*Job, err error) {
+	if discard {
+		jobs = self.sched.close()
+	} else {
+		self.sched.drain()
 	}
-	close(self.jobpipe_level1)
-	if self.allowLevel {
-		close(self.jobpipe_level2)
-		close(self.jobpipe_level3)
+	done := make(chan struct{})
+	go func() {
+		self.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	self.cancel()
+	//没有工人(未 Run)或等待超时时队列中还有任务
+	jobs = append(jobs, self.sched.close()...)
+	failJobs(jobs)
+	return jobs, err
+}
+
+func failJobs(jobs []*Job) {
+	for _, job := range jobs {
+		job.fail(ErrPoolClosed)
 	}
 }
 
@@ -170,28 +400,14 @@ func (self *Worker) work(pool *WorkPool) {
 			go worker.work(pool)
 		}
 	}()
-	if pool.allowLevel {
-		for {
-			select {
-			case job := <-pool.jobpipe_level1:
-				job.proc()
-			case job := <-pool.jobpipe_level2:
-				job.proc()
-			case job := <-pool.jobpipe_level3:
-				job.proc()
-			case <-self.delcmd:
-				break
-			}
-		}
-	} else {
-		for {
-			select {
-			case job := <-pool.jobpipe_level1:
-				job.proc()
-			case <-self.delcmd:
-				break
-			}
+	for {
+		job, ok := pool.sched.pop()
+		if !ok {
+			break
 		}
+		job.proc(pool)
 	}
 	self.status = 2
+	//异常结束时由接替的工人计数
+	pool.running.Done()
 }
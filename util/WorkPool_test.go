@@ -0,0 +1,200 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//等待条件成立
+func eventually(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//不限时的任务执行中被取消，计入 Cancelled 而不是 Completed
+func TestStatsCancelUntimed(t *testing.T) {
+	pool := newTestPool(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	future := pool.SubmitCtx(ctx, 1, 0, func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, nil
+	})
+	<-started
+	cancel()
+	future.Wait(context.Background())
+	eventually(t, time.Second, func() bool { return pool.Stats().Cancelled == 1 })
+	if stats := pool.Stats(); stats.Completed != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+//限时任务超时被放弃后仍在运行时计入 Abandoned，结束后减回
+func TestStatsAbandoned(t *testing.T) {
+	pool := newTestPool(t)
+	release := make(chan struct{})
+	future := pool.SubmitCtx(context.Background(), 1, 10*time.Millisecond, func(ctx context.Context) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	if err := future.Err(); err != context.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	eventually(t, time.Second, func() bool { return pool.Stats().Abandoned == 1 })
+	if stats := pool.Stats(); stats.Timeouts != 1 || stats.Completed != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+	close(release)
+	eventually(t, time.Second, func() bool { return pool.Stats().Abandoned == 0 })
+}
+
+//结果已交给 Future 的任务即使协程在截止后才返回，也不计入超时
+func TestStatsFinishAtDeadline(t *testing.T) {
+	pool := newTestPool(t)
+	future := newFuture()
+	pool.addJob(1, &Job{
+		ctx:     context.Background(),
+		timeout: 10 * time.Millisecond,
+		ctxfun: func(ctx context.Context) {
+			future.complete(1, nil)
+			<-ctx.Done()
+		},
+		future: future,
+	})
+	if val, err := future.Wait(context.Background()); val != 1 || err != nil {
+		t.Fatal(val, err)
+	}
+	eventually(t, time.Second, func() bool { return pool.Stats().Completed == 1 })
+	if stats := pool.Stats(); stats.Timeouts != 0 || stats.Abandoned != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+//阻塞工人的任务，返回释放函数
+func blockWorker(pool *WorkPool) (started chan struct{}, release func()) {
+	started = make(chan struct{})
+	block := make(chan struct{})
+	pool.AddJob(1, func(...interface{}) {
+		close(started)
+		<-block
+	})
+	return started, func() { close(block) }
+}
+
+//Shutdown 执行完排队中的任务，ShutdownNow 丢弃并交回
+func TestShutdownDrainDiscard(t *testing.T) {
+	for _, discard := range []bool{false, true} {
+		pool := NewWorkPool(16, 1)
+		pool.Run()
+		started, release := blockWorker(pool)
+		<-started
+		futures := make([]*Future, 5)
+		for i := range futures {
+			futures[i] = pool.Submit(1, func() (interface{}, error) { return 1, nil })
+		}
+		result := make(chan []*Job, 1)
+		go func() {
+			var jobs []*Job
+			var err error
+			if discard {
+				jobs, err = pool.ShutdownNow(context.Background())
+			} else {
+				jobs, err = pool.Shutdown(context.Background())
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			result <- jobs
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := pool.Submit(1, func() (interface{}, error) { return 1, nil }).Err(); err != ErrPoolClosed {
+			t.Fatalf("submit after shutdown: %v", err)
+		}
+		release()
+		jobs := <-result
+		for _, future := range futures {
+			err := future.Err()
+			if discard && err != ErrPoolClosed || !discard && err != nil {
+				t.Fatalf("discard %v: future err %v", discard, err)
+			}
+		}
+		if discard && len(jobs) != len(futures) || !discard && len(jobs) != 0 {
+			t.Fatalf("discard %v: %d jobs returned", discard, len(jobs))
+		}
+		if discard && jobs[0].Future() != futures[0] {
+			t.Fatal("returned job has a different future")
+		}
+	}
+}
+
+//Shutdown 唤醒因队列满而阻塞的提交者，它的任务以 ErrPoolClosed 结束
+func TestShutdownBlockedProducer(t *testing.T) {
+	pool := NewWorkPool(1, 1)
+	pool.Run()
+	started, release := blockWorker(pool)
+	<-started
+	pool.AddJob(1, func(...interface{}) {})
+	blocked := make(chan *Future, 1)
+	go func() { blocked <- pool.Submit(1, func() (interface{}, error) { return 1, nil }) }()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Shutdown(context.Background())
+		done <- err
+	}()
+	select {
+	case future := <-blocked:
+		if err := future.Err(); err != ErrPoolClosed {
+			t.Fatalf("want ErrPoolClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("producer still blocked")
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+//ctx 先结束时返回未执行的任务，取消执行中的 context 任务，交回的任务可以用 Run 执行
+func TestShutdownCtxExpired(t *testing.T) {
+	pool := NewWorkPool(16, 1)
+	pool.Run()
+	started := make(chan struct{})
+	running := pool.SubmitCtx(context.Background(), 1, 0, func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+	ran := 0
+	for i := 0; i < 3; i++ {
+		pool.AddJob(1, func(...interface{}) { ran++ })
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	jobs, err := pool.Shutdown(ctx)
+	if err != context.DeadlineExceeded || len(jobs) != 3 {
+		t.Fatalf("err %v, %d jobs", err, len(jobs))
+	}
+	if err := running.Err(); err != context.Canceled {
+		t.Fatalf("running job: %v", err)
+	}
+	for _, job := range jobs {
+		if job.Context() != nil {
+			t.Fatal("plain job has a context")
+		}
+		job.Run()
+	}
+	pool.Wait()
+	if ran != 3 {
+		t.Fatalf("ran %d", ran)
+	}
+}
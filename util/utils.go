@@ -8,8 +8,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"runtime"
 	"unicode/utf8"
 	"strings"
@@ -104,49 +102,18 @@ func GetFirstArg() string {
 }
 
 //子任务进程标示
+//
+//Deprecated: 进程角色已改由环境变量 SUPERVISOR_ENV 传递，子进程的命令行中不再有这个参数，GetFirstArg 仍会跳过它以兼容旧版本
 const SUB_COMMAND = "-childproc"
 
-//开启守护进程 ，父进程监护子进程 , 适用linux系统
+//开启守护进程，守护进程监护子进程，子进程异常退出后按退避时间重启
+//返回true的是执行业务的子进程，其它进程返回false后应直接退出
+//当前进程是1号进程(容器)或设置了 INVOCATION_ID 环境变量(systemd 启动的服务)时不转入后台，当前进程直接作为守护进程
+//其它进程管理器(例如 supervisord)下不会自动识别，需使用 NewSupervisor 并设置 Foreground 为true
+//需要pid文件、日志重定向、重启次数限制等配置时使用 NewSupervisor
 func Fork() bool {
-	if strings.ToLower(runtime.GOOS) != "windows" {
-		//将当前进程修改为守护进程 让其被1号进程接管  则 父进程ID为1
-		//父进程不是1且又不是任务子进程，则是首次启动进程，启动监控进程（监控进程pid为1），退出当前进程
-		if os.Getppid() != 1 && os.Args[len(os.Args)-1] != SUB_COMMAND {
-
-			//将命令行参数中执行文件路径转换成可用路径
-			filePath, _ := filepath.Abs(os.Args[0])
-			cmd := exec.Command(filePath, os.Args[1:]...)
-			//将其他命令传入生成出的进程
-			//给新进程设置文件描述符，可以重定向到文件中
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			//开始执行新进程，不等待新进程退出
-			cmd.Start()
-			fmt.Println("Keeper started !")
-			return false
-		}
-
-		//监护进程，监护进程的目的是放在子进程意外挂掉，子进程挂掉后由监护进程再次启动
-		if os.Getppid() == 1 {
-			//父进程
-			//将命令行参数中执行文件路径转换成可用路径
-			filePath, _ := filepath.Abs(os.Args[0])
-			for {
-				cmd := exec.Command(filePath, append(os.Args[1:], SUB_COMMAND)...)
-				//开始执行新进程
-				cmd.Start()
-				//等待新的子进程退出
-				err := cmd.Wait()
-				if err != nil {
-
-				} else {
-
-					return false
-				}
-			}
-		}
-
+	if strings.ToLower(runtime.GOOS) == "windows" {
+		return true
 	}
-	return true
+	return NewSupervisor().Run()
 }